@@ -8,4 +8,5 @@ require (
 	github.com/fatih/color v1.7.0
 	github.com/mitchellh/copystructure v1.2.0
 	github.com/spf13/cobra v1.1.3
+	gopkg.in/yaml.v3 v3.0.1
 )
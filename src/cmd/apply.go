@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(applyCmd)
+
+	applyCmd.Flags().StringVarP(&deploymentOptions.Role, "role", "r", "", "An IAM role ARN to assume before invoking a deployment. Default: the role the plan was made with")
+
+	applyCmd.Flags().BoolVarP(&noWait, "no-wait", "w", false, "Deploy and exit; Do not wait for service to reach stable state. Default: as planned")
+
+	applyCmd.Flags().BoolVar(&rollbackOnFailure, "rollback-on-failure", false, "When the service does not stabilize, restore the previous task definition and VERSION parameter and wait for it. Default: as planned")
+
+	addLockFlags(applyCmd)
+}
+
+var applyCmd = &cobra.Command{
+	Use:   "apply <plan file>",
+	Short: "Execute a plan saved by plan, unless the service changed since",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+		report := newReport("apply")
+
+		pf, err := loadPlan(args[0])
+		if err != nil {
+			report.fail(OutcomeFailedToInvoke, ExitError, err)
+		}
+		plan := pf.Plan
+
+		// The plan's options apply, except for the role and lock settings given to apply
+		options := plan.Options
+		if deploymentOptions.Role != "" {
+			options.Role = deploymentOptions.Role
+		}
+		options.NoLock = deploymentOptions.NoLock
+		options.LockTimeout = deploymentOptions.LockTimeout
+		options.LockTTL = deploymentOptions.LockTTL
+		options.LockOwner = deploymentOptions.LockOwner
+		deploymentOptions = options
+		// --no-wait and --rollback-on-failure given to apply override the planned settings, including to turn them off
+		if !cmd.Flags().Changed("no-wait") {
+			noWait = pf.NoWait
+		}
+		if !cmd.Flags().Changed("rollback-on-failure") {
+			rollbackOnFailure = pf.RollbackOnFailure
+		}
+		if noWait && plan.Canary != nil {
+			report.fail(OutcomeFailedToInvoke, ExitError, fmt.Errorf("a canary plan cannot be applied with --no-wait"))
+		}
+		if noWait && plan.Options.SetVersionAfterStable {
+			report.fail(OutcomeFailedToInvoke, ExitError, fmt.Errorf("a plan made with --version-param-after-stable cannot be applied with --no-wait"))
+		}
+		if noWait && len(plan.Options.SmokeTests) > 0 {
+			report.fail(OutcomeFailedToInvoke, ExitError, fmt.Errorf("a plan with smoke tests cannot be applied with --no-wait"))
+		}
+		if noWait && plan.Options.Bake > 0 {
+			report.fail(OutcomeFailedToInvoke, ExitError, fmt.Errorf("a plan with a bake period cannot be applied with --no-wait"))
+		}
+
+		report.Application = deploymentOptions.Application
+		report.Environment = deploymentOptions.Environment
+		report.Version = deploymentOptions.Version
+		report.hooks = pf.Hooks
+
+		// A plan made for another region is applied there
+		if pf.Region != "" {
+			regions = []string{pf.Region}
+		}
+		targets, err := parseTargets(newClient())
+		if err != nil {
+			report.fail(OutcomeFailedToInvoke, ExitError, err)
+		}
+		client := targets[0].client
+		report.lock(ctx, client, deploymentOptions)
+
+		say("\nApplying plan made %s: %s to %s\n", pf.Created.Local().Format("2006-01-02 15:04:05"), shipped(deploymentOptions), deploymentOptions.Environment)
+		if outputFormat == outputText {
+			fmt.Println(plan)
+		}
+
+		// Holding the lock, nothing else can change the service between this check and the update
+		err = client.CheckPlan(ctx, plan)
+		if err != nil {
+			report.fail(OutcomeFailedToInvoke, ExitFailedToInvoke, err)
+		}
+
+		report.runPreDeployHooks(ctx)
+
+		depRes, err := client.ApplyPlan(ctx, plan)
+		if err != nil && depRes == nil {
+			report.fail(OutcomeFailedToInvoke, ExitFailedToInvoke, err)
+		}
+		// The service was updated even when writing the version parameter failed
+		report.versionErr = err
+		report.plan = plan
+
+		report.succeed(ctx, client, depRes, fmt.Sprintf("%s successfully updated in %s", shipped(deploymentOptions), deploymentOptions.Environment))
+	},
+}
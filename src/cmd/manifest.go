@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/justmiles/ecs-deploy/src/deployer"
+	"github.com/spf13/cobra"
+)
+
+// HookReport is the outcome of a manifest hook command
+type HookReport struct {
+	// Hook is preDeploy, postDeploy or onFailure
+	Hook     string `json:"Hook"`
+	Command  string `json:"Command"`
+	Duration string `json:"Duration"`
+	Error    string `json:"Error,omitempty"`
+}
+
+// applyManifest sets the deployment options defined by the manifest for the target environment. Flags given on the
+// command line take precedence over the manifest.
+func applyManifest(cmd *cobra.Command, path string) (*deployer.ManifestSpec, error) {
+	manifest, err := deployer.LoadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := manifest.ForEnvironment(deploymentOptions.Environment)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := cmd.Flags()
+	if spec.Application != "" && !flags.Changed("application") {
+		deploymentOptions.Application = spec.Application
+	}
+	if len(spec.Services) > 0 && !flags.Changed("application") {
+		deploymentOptions.Application = strings.Join(spec.Services, ",")
+	}
+	if len(spec.Regions) > 0 && !flags.Changed("region") {
+		regions = spec.Regions
+	}
+	if len(spec.Roles) > 0 && !flags.Changed("target-role") {
+		targetRoles = spec.Roles
+	}
+	if len(spec.Waves) > 0 && !flags.Changed("wave") {
+		waveSpecs = spec.Waves
+	}
+	if spec.WavePause > 0 && !flags.Changed("wave-pause") {
+		wavePause = time.Duration(spec.WavePause)
+	}
+	if len(spec.Images) > 0 && !flags.Changed("image") {
+		deploymentOptions.Images = map[string]string{}
+		for name, version := range spec.Images {
+			if version == "" {
+				version = deploymentOptions.Version
+			}
+			deploymentOptions.Images[name] = version
+		}
+	}
+	if len(spec.Secrets.Prefixes) > 0 && !flags.Changed("secrets-prefix") {
+		deploymentOptions.SecretsPrefix = spec.Secrets.Prefixes
+	}
+	if spec.Secrets.Refresh && !flags.Changed("refresh-secrets") {
+		deploymentOptions.RefreshSecrets = true
+	}
+	if len(spec.SmokeTests) > 0 && !flags.Changed("smoke-test") {
+		deploymentOptions.SmokeTests = spec.SmokeTests
+	}
+
+	// The task and service settings have no flags
+	deploymentOptions.ContainerEnvironment = spec.Env
+	deploymentOptions.Cpu = spec.Cpu
+	deploymentOptions.Memory = spec.Memory
+	deploymentOptions.DesiredCount = spec.DesiredCount
+
+	wait := spec.Wait
+	if wait.MaxAttempts > 0 && !flags.Changed("max-attempts") {
+		deploymentOptions.MaxAttempts = wait.MaxAttempts
+	}
+	if wait.FailureThreshold != nil && !flags.Changed("failure-threshold") {
+		deploymentOptions.FailureThreshold = *wait.FailureThreshold
+	}
+	if wait.SkipTargetHealth && !flags.Changed("skip-target-health") {
+		deploymentOptions.SkipTargetHealth = true
+	}
+	if wait.NoWait && !flags.Changed("no-wait") {
+		noWait = true
+	}
+	if wait.RollbackOnFailure && !flags.Changed("rollback-on-failure") {
+		rollbackOnFailure = true
+	}
+	if wait.Bake > 0 && !flags.Changed("bake") {
+		deploymentOptions.Bake = wait.Bake
+	}
+	if len(wait.Alarms) > 0 && !flags.Changed("alarm") {
+		deploymentOptions.BakeAlarms = wait.Alarms
+	}
+
+	return spec, nil
+}
+
+// runHooks runs each command with sh -c, stopping at the first that fails. The deployment is described to the
+// commands by the ECS_DEPLOY_APPLICATION, ECS_DEPLOY_ENVIRONMENT, ECS_DEPLOY_VERSION, ECS_DEPLOY_OUTCOME and
+// ECS_DEPLOY_TASK_DEFINITION environment variables.
+func (report *Report) runHooks(ctx context.Context, hook string, commands []string) error {
+	for _, command := range commands {
+		say("Running %s hook: %s\n", hook, command)
+
+		start := time.Now()
+		c := exec.CommandContext(ctx, "sh", "-c", command)
+		c.Stdout = progress()
+		c.Stderr = progress()
+		c.Env = append(os.Environ(),
+			"ECS_DEPLOY_APPLICATION="+report.Application,
+			"ECS_DEPLOY_ENVIRONMENT="+report.Environment,
+			"ECS_DEPLOY_VERSION="+report.Version,
+			"ECS_DEPLOY_OUTCOME="+report.Outcome,
+		)
+		if report.Results != nil {
+			c.Env = append(c.Env, "ECS_DEPLOY_TASK_DEFINITION="+report.Results.TaskDefinition)
+		}
+		err := c.Run()
+
+		hookReport := HookReport{
+			Hook:     hook,
+			Command:  command,
+			Duration: time.Since(start).Round(time.Millisecond).String(),
+		}
+		if err != nil {
+			hookReport.Error = err.Error()
+		}
+		report.Hooks = append(report.Hooks, hookReport)
+		if err != nil {
+			return fmt.Errorf("%s hook %q failed: %v", hook, command, err)
+		}
+	}
+	return nil
+}
+
+// runPreDeployHooks runs the manifest's preDeploy hooks, exiting when one fails
+func (report *Report) runPreDeployHooks(ctx context.Context) {
+	if report.hooks == nil {
+		return
+	}
+	err := report.runHooks(ctx, "preDeploy", report.hooks.PreDeploy)
+	if err != nil {
+		report.fail(OutcomeFailedToInvoke, ExitFailedToInvoke, err)
+	}
+}
+
+// runExitHooks runs the postDeploy hooks after a successful deployment, or the onFailure hooks after a failed one
+func (report *Report) runExitHooks() {
+	hooks := report.hooks
+	if hooks == nil {
+		return
+	}
+	// A failing hook exits through fail again
+	report.hooks = nil
+
+	// Hooks still run after an interrupt cancelled the command's context
+	ctx := context.Background()
+	switch {
+	case report.Outcome == OutcomeSucceeded && report.ExitCode == ExitOK:
+		err := report.runHooks(ctx, "postDeploy", hooks.PostDeploy)
+		if err != nil {
+			report.fail(OutcomeSucceeded, ExitError, err)
+		}
+	case report.ExitCode != ExitOK:
+		err := report.runHooks(ctx, "onFailure", hooks.OnFailure)
+		if err != nil {
+			say("%v\n", err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const testManifest = `schemaVersion: 1
+application: app
+regions: [us-east-1]
+images:
+  web: ""
+  sidecar: "2.0"
+wavePause: 5m
+wait:
+  maxAttempts: 60
+  rollbackOnFailure: true
+environments:
+  prd:
+    regions: [us-east-1, eu-west-1]
+    desiredCount: 6
+`
+
+// manifestCommand returns a command with the ship flags set from args, restoring the flag variables once the test ends
+func manifestCommand(t *testing.T, args ...string) *cobra.Command {
+	savedOptions, savedRegions, savedRoles, savedWaves, savedPause := deploymentOptions, regions, targetRoles, waveSpecs, wavePause
+	savedNoWait, savedRollback, savedSmokeTests := noWait, rollbackOnFailure, smokeTests
+	t.Cleanup(func() {
+		deploymentOptions, regions, targetRoles, waveSpecs, wavePause = savedOptions, savedRegions, savedRoles, savedWaves, savedPause
+		noWait, rollbackOnFailure, smokeTests = savedNoWait, savedRollback, savedSmokeTests
+	})
+
+	cmd := &cobra.Command{Use: "ship"}
+	addShipFlags(cmd)
+	addTargetFlags(cmd)
+	cmd.Flags().StringArrayVar(&waveSpecs, "wave", []string{}, "")
+	cmd.Flags().DurationVar(&wavePause, "wave-pause", 0, "")
+	err := cmd.ParseFlags(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+// writeManifest writes manifest to a temporary ecs-deploy.yaml, returning its path
+func writeManifest(t *testing.T, manifest string) string {
+	path := filepath.Join(t.TempDir(), "ecs-deploy.yaml")
+	err := os.WriteFile(path, []byte(manifest), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyManifest(t *testing.T) {
+	path := writeManifest(t, testManifest)
+
+	tests := []struct {
+		name            string
+		args            []string
+		wantApplication string
+		wantRegions     []string
+		wantImages      map[string]string
+		wantMaxAttempts int
+		wantPause       time.Duration
+	}{
+		{
+			name:            "manifest",
+			args:            []string{"-e", "prd", "-v", "1.2"},
+			wantApplication: "app",
+			wantRegions:     []string{"us-east-1", "eu-west-1"},
+			wantImages:      map[string]string{"web": "1.2", "sidecar": "2.0"},
+			wantMaxAttempts: 60,
+			wantPause:       5 * time.Minute,
+		},
+		{
+			name:            "flags take precedence",
+			args:            []string{"-e", "prd", "-v", "1.2", "-a", "worker", "--region", "us-west-2", "--image", "web=1.3", "--max-attempts", "10", "--wave-pause", "1m"},
+			wantApplication: "worker",
+			wantRegions:     []string{"us-west-2"},
+			wantImages:      map[string]string{"web": "1.3"},
+			wantMaxAttempts: 10,
+			wantPause:       time.Minute,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd := manifestCommand(t, test.args...)
+
+			_, err := applyManifest(cmd, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if deploymentOptions.Application != test.wantApplication {
+				t.Errorf("Application = %s, want %s", deploymentOptions.Application, test.wantApplication)
+			}
+			if !reflect.DeepEqual(regions, test.wantRegions) {
+				t.Errorf("regions = %v, want %v", regions, test.wantRegions)
+			}
+			if !reflect.DeepEqual(deploymentOptions.Images, test.wantImages) {
+				t.Errorf("Images = %v, want %v", deploymentOptions.Images, test.wantImages)
+			}
+			if deploymentOptions.MaxAttempts != test.wantMaxAttempts {
+				t.Errorf("MaxAttempts = %d, want %d", deploymentOptions.MaxAttempts, test.wantMaxAttempts)
+			}
+			if wavePause != test.wantPause {
+				t.Errorf("wavePause = %v, want %v", wavePause, test.wantPause)
+			}
+			// Settings without a flag always come from the manifest
+			if got := deploymentOptions.DesiredCount; got == nil || *got != 6 {
+				t.Errorf("DesiredCount = %v, want 6", got)
+			}
+			if !rollbackOnFailure {
+				t.Error("rollbackOnFailure not set from the manifest")
+			}
+		})
+	}
+}
+
+func TestApplyManifestErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		wantErr  string
+	}{
+		{name: "unknown key", manifest: "schemaVersion: 1\napplication: app\nreplicas: 2\n", wantErr: "line 3: field replicas not found"},
+		{name: "invalid overlay", manifest: "schemaVersion: 1\nenvironments:\n  prd:\n    wait:\n      bake: soon\n", wantErr: `line 5: invalid duration "soon"`},
+		{name: "unsupported schemaVersion", manifest: "schemaVersion: 2\n", wantErr: "line 1: unsupported schemaVersion 2, expected 1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeManifest(t, test.manifest)
+			cmd := manifestCommand(t, "-e", "prd")
+
+			_, err := applyManifest(cmd, path)
+			want := path + ": " + test.wantErr
+			if err == nil || !strings.HasPrefix(err.Error(), want) {
+				t.Fatalf("applyManifest() error = %v, want %s", err, want)
+			}
+		})
+	}
+
+	_, err := applyManifest(manifestCommand(t, "-e", "prd"), filepath.Join(t.TempDir(), "missing.yaml"))
+	if err == nil {
+		t.Error("applyManifest() of a missing file succeeded")
+	}
+}
@@ -0,0 +1,548 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/justmiles/ecs-deploy/src/deployer"
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats accepted by --output
+const (
+	outputText = "text"
+	outputJSON = "json"
+	outputYAML = "yaml"
+)
+
+// Exit codes are stable across releases so CI can branch on them
+const (
+	// ExitOK the command succeeded
+	ExitOK = 0
+	// ExitError invalid usage or an unexpected error
+	ExitError = 1
+	// ExitFailedToInvoke the deployment could not be started; nothing was changed in ECS
+	ExitFailedToInvoke = 3
+	// ExitDidNotStabilize the deployment started but the service did not reach a stable state
+	ExitDidNotStabilize = 4
+	// ExitRolledBack the deployment failed and the service was rolled back to its previous task definition
+	ExitRolledBack = 5
+)
+
+// Outcomes reported in Report.Outcome
+const (
+	OutcomeSucceeded       = "succeeded"
+	OutcomeDryRun          = "dry-run"
+	OutcomePlanned         = "planned"
+	OutcomeInvoked         = "invoked"
+	OutcomeFailedToInvoke  = "failed to invoke"
+	OutcomeDidNotStabilize = "did not stabilize"
+	OutcomeRolledBack      = "rolled back"
+)
+
+// reportSchemaVersion is bumped whenever a field of Report is removed or changes meaning
+const reportSchemaVersion = 1
+
+// cleanupTimeout bounds restoring a failed deployment once the command was interrupted
+const cleanupTimeout = 30 * time.Minute
+
+// Report is the single document written by every command with --output json or yaml
+type Report struct {
+	// SchemaVersion of this document
+	SchemaVersion int `json:"SchemaVersion"`
+	// Command that produced the report, e.g. ship
+	Command     string `json:"Command"`
+	Application string `json:"Application"`
+	Environment string `json:"Environment"`
+	Version     string `json:"Version,omitempty"`
+	// Outcome is one of: succeeded, dry-run, planned, invoked (with --no-wait), failed to invoke, did not stabilize, rolled back
+	Outcome string `json:"Outcome"`
+	// ExitCode the process exits with
+	ExitCode int `json:"ExitCode"`
+	// Error message when the command failed
+	Error string `json:"Error,omitempty"`
+	// Results of the deployment, including its Plan
+	Results *deployer.DeploymentResults `json:"Results,omitempty"`
+	// Wait is the outcome of waiting for the service to reach a stable state
+	Wait *WaitReport `json:"Wait,omitempty"`
+	// Bake is the outcome of watching alarms once the service was stable
+	Bake *BakeReport `json:"Bake,omitempty"`
+	// Shift is the outcome of shifting traffic to the idle service of a blue/green pair
+	Shift *ShiftReport `json:"Shift,omitempty"`
+	// Canary is the outcome of promoting the canary task set of an EXTERNAL service
+	Canary *CanaryReport `json:"Canary,omitempty"`
+	// Rollback is the outcome of rolling back a deployment that did not stabilize
+	Rollback *RollbackReport `json:"Rollback,omitempty"`
+	// Lock is the deployment lock that kept the command from running, or the one removed by unlock
+	Lock *deployer.Lock `json:"Lock,omitempty"`
+	// Hooks are the manifest hook commands that ran
+	Hooks []HookReport `json:"Hooks,omitempty"`
+	// Services are the outcome for each service when several services or targets were given, e.g. ship -a web,worker
+	Services []*ServiceReport `json:"Services,omitempty"`
+	// SmokeTests are the results of the smoke tests run once all of several services were stable
+	SmokeTests []deployer.SmokeTestResult `json:"SmokeTests,omitempty"`
+	// Waves are the outcome of each wave of a deployment to several targets deployed in waves
+	Waves []*WaveReport `json:"Waves,omitempty"`
+
+	// plan applied by ship; used to publish or revert the version parameter and to roll back
+	plan *deployer.Plan
+	// versionErr is the failure to write the version parameter once the service was updated
+	versionErr error
+	// shift is the blue/green pair traffic is shifted between by shift
+	shift *deployer.ShiftTarget
+	// hooks of the manifest shipped with --file
+	hooks *deployer.ManifestHooks
+	// unlock releases the deployment locks, if any are held
+	unlock func()
+}
+
+// WaitReport is the outcome of waiting for a deployment
+type WaitReport struct {
+	Stable   bool   `json:"Stable"`
+	Duration string `json:"Duration"`
+	Error    string `json:"Error,omitempty"`
+	// StoppedTasks of the new deployment when it was aborted for crossing the failure threshold
+	StoppedTasks []deployer.StoppedTask `json:"StoppedTasks,omitempty"`
+	// Unhealthy are the new tasks' load balancer targets that were not healthy when waiting gave up
+	Unhealthy []deployer.TargetHealth `json:"Unhealthy,omitempty"`
+}
+
+// BakeReport is the outcome of the bake period
+type BakeReport struct {
+	Duration string   `json:"Duration"`
+	Alarms   []string `json:"Alarms"`
+	// Triggered are the alarms that went to ALARM, failing the deployment
+	Triggered []deployer.AlarmState `json:"Triggered,omitempty"`
+	Error     string                `json:"Error,omitempty"`
+}
+
+// ShiftReport is the outcome of shifting traffic between a blue/green pair
+type ShiftReport struct {
+	ListenerRule string `json:"ListenerRule"`
+	// Live is the service that served traffic before the shift and Idle the one traffic was shifted to
+	Live string `json:"Live"`
+	Idle string `json:"Idle"`
+	// Shifted is the percentage of traffic on Idle when the shift finished or failed
+	Shifted  int64  `json:"Shifted"`
+	Duration string `json:"Duration"`
+	// Unhealthy are the idle service's targets that failed their health check
+	Unhealthy []deployer.TargetHealth `json:"Unhealthy,omitempty"`
+	// Triggered are the alarms that went to ALARM during the shift
+	Triggered []deployer.AlarmState `json:"Triggered,omitempty"`
+	// Restored is set when traffic was returned to Live after a failure
+	Restored bool   `json:"Restored,omitempty"`
+	Error    string `json:"Error,omitempty"`
+}
+
+// CanaryReport is the outcome of a canary release
+type CanaryReport struct {
+	// TaskSet is the ARN of the canary task set
+	TaskSet string `json:"TaskSet"`
+	// Scale is the percentage of the desired count the canary ran at before promotion
+	Scale float64 `json:"Scale"`
+	// Promoted is set once the canary task set is the service's primary task set
+	Promoted bool   `json:"Promoted"`
+	Duration string `json:"Duration,omitempty"`
+	Error    string `json:"Error,omitempty"`
+}
+
+// RollbackReport is the outcome of an automatic rollback
+type RollbackReport struct {
+	// TaskDefinition the service was rolled back to
+	TaskDefinition string      `json:"TaskDefinition,omitempty"`
+	Wait           *WaitReport `json:"Wait,omitempty"`
+	Error          string      `json:"Error,omitempty"`
+}
+
+func newReport(command string) *Report {
+	return &Report{
+		SchemaVersion: reportSchemaVersion,
+		Command:       command,
+		Application:   deploymentOptions.Application,
+		Environment:   deploymentOptions.Environment,
+		Version:       deploymentOptions.Version,
+	}
+}
+
+// fail records err with outcome and exits
+func (report *Report) fail(outcome string, exitCode int, err error) {
+	report.Outcome = outcome
+	report.ExitCode = exitCode
+	report.Error = err.Error()
+	if outputFormat == outputText {
+		fmt.Println(err)
+	}
+	report.exit()
+}
+
+// wait waits for the service to reach a stable state, for its CodeDeploy deployment to complete, or for its task set to
+// reach a steady state, returning the outcome. Progress is written to out.
+func wait(ctx context.Context, client *deployer.Client, depOpts deployer.DeploymentOptions, results *deployer.DeploymentResults, out io.Writer) (*WaitReport, error) {
+	start := time.Now()
+	var err error
+	if results.TaskSet != "" {
+		fmt.Fprintf(out, "Waiting for task set %s to reach a steady state\n", results.TaskSet)
+		err = client.WaitForTaskSet(ctx, depOpts, results.TaskSet)
+	} else if results.CodeDeployDeploymentID != "" {
+		fmt.Fprintf(out, "Waiting for CodeDeploy deployment %s to complete\n", results.CodeDeployDeploymentID)
+		err = client.WaitForCodeDeployDeployment(ctx, depOpts, results.CodeDeployDeploymentID)
+	} else {
+		fmt.Fprintf(out, "Waiting for service to reach stable state\n")
+		err = client.WaitForDeployment(ctx, depOpts)
+	}
+	waitReport := &WaitReport{
+		Stable:   err == nil,
+		Duration: time.Since(start).Round(time.Second).String(),
+	}
+	if err != nil {
+		waitReport.Error = err.Error()
+	}
+
+	var taskFailureError *deployer.TaskFailureError
+	if errors.As(err, &taskFailureError) {
+		waitReport.StoppedTasks = taskFailureError.StoppedTasks
+	}
+	var unhealthyTargetsError *deployer.UnhealthyTargetsError
+	if errors.As(err, &unhealthyTargetsError) {
+		waitReport.Unhealthy = unhealthyTargetsError.Targets
+	}
+	return waitReport, err
+}
+
+// succeed records the results of an invoked deployment, waiting for it unless --no-wait is set, and exits
+func (report *Report) succeed(ctx context.Context, client *deployer.Client, results *deployer.DeploymentResults, message string) {
+	report.Results = results
+
+	if debugEnabled {
+		b, _ := json.Marshal(results)
+		say("%s\n", b)
+	}
+
+	report.Outcome = OutcomeInvoked
+	if !noWait {
+		var err error
+		// A canary task set that does not stabilize is always deleted
+		rollback := rollbackOnFailure || report.plan != nil && report.plan.Canary != nil
+
+		report.Wait, err = wait(ctx, client, deploymentOptions, results, progress())
+		if err != nil {
+			report.failed(ctx, client, err, rollback)
+		}
+
+		if len(deploymentOptions.SmokeTests) > 0 {
+			say("Running %d smoke tests\n", len(deploymentOptions.SmokeTests))
+			results.SmokeTests, err = client.RunSmokeTests(ctx, deploymentOptions)
+			if err != nil {
+				report.failed(ctx, client, err, rollback)
+			}
+		}
+
+		if report.shift != nil {
+			err = report.shiftTraffic(ctx, client)
+			if err != nil {
+				report.failed(ctx, client, err, true)
+			}
+		}
+
+		if report.plan != nil && deploymentOptions.Bake > 0 {
+			err = report.bake(ctx, client)
+			if err != nil {
+				// A triggered alarm always rolls back
+				report.failed(ctx, client, err, true)
+			}
+		}
+
+		if report.plan != nil && report.plan.Canary != nil {
+			err = report.promote(ctx, client)
+			if err != nil {
+				report.failed(ctx, client, err, true)
+			}
+		}
+		report.Outcome = OutcomeSucceeded
+
+		if report.plan != nil && report.plan.Options.SetVersionAfterStable {
+			err = client.PublishVersion(ctx, report.plan)
+			if err != nil {
+				report.fail(OutcomeSucceeded, ExitError, fmt.Errorf("service is stable but setting the version parameter failed: %v", err))
+			}
+		}
+	}
+
+	if report.versionErr != nil {
+		report.fail(report.Outcome, ExitError, report.versionErr)
+	}
+
+	say("%s\n", message)
+	report.exit()
+}
+
+// bake watches the alarms for the bake period, recording the outcome in the report
+func (report *Report) bake(ctx context.Context, client *deployer.Client) error {
+	if len(deploymentOptions.BakeAlarms) == 0 {
+		say("Holding for %s\n", time.Duration(deploymentOptions.Bake))
+	} else {
+		say("Baking for %s while watching alarms %s\n", time.Duration(deploymentOptions.Bake), strings.Join(deploymentOptions.BakeAlarms, ", "))
+	}
+
+	start := time.Now()
+	err := client.Bake(ctx, deploymentOptions)
+	report.Bake = &BakeReport{
+		Duration: time.Since(start).Round(time.Second).String(),
+		Alarms:   deploymentOptions.BakeAlarms,
+	}
+	if err != nil {
+		report.Bake.Error = err.Error()
+	}
+
+	var alarmError *deployer.AlarmError
+	if errors.As(err, &alarmError) {
+		report.Bake.Triggered = alarmError.Alarms
+	}
+	return err
+}
+
+// shiftTraffic shifts traffic to the idle service, recording the outcome in the report
+func (report *Report) shiftTraffic(ctx context.Context, client *deployer.Client) error {
+	say("Shifting traffic from %s to %s\n", report.shift.Live, report.shift.Idle)
+
+	start := time.Now()
+	err := client.ShiftTraffic(ctx, deploymentOptions, report.shift)
+	report.Shift = &ShiftReport{
+		ListenerRule: report.shift.ListenerRule,
+		Live:         report.shift.Live,
+		Idle:         report.shift.Idle,
+		Shifted:      report.shift.Shifted,
+		Duration:     time.Since(start).Round(time.Second).String(),
+	}
+	if err != nil {
+		report.Shift.Error = err.Error()
+	}
+
+	var unhealthyTargetsError *deployer.UnhealthyTargetsError
+	if errors.As(err, &unhealthyTargetsError) {
+		report.Shift.Unhealthy = unhealthyTargetsError.Targets
+	}
+	var alarmError *deployer.AlarmError
+	if errors.As(err, &alarmError) {
+		report.Shift.Triggered = alarmError.Alarms
+	}
+	return err
+}
+
+// promote promotes the canary task set to primary, recording the outcome in the report
+func (report *Report) promote(ctx context.Context, client *deployer.Client) error {
+	canary := report.plan.Canary
+	say("Promoting task set %s\n", canary.TaskSet)
+
+	start := time.Now()
+	err := client.PromoteCanary(ctx, report.plan)
+	report.Canary = &CanaryReport{
+		TaskSet:  canary.TaskSet,
+		Scale:    canary.Scale,
+		Promoted: canary.Promoted,
+		Duration: time.Since(start).Round(time.Second).String(),
+	}
+	if err != nil {
+		report.Canary.Error = err.Error()
+	}
+	return err
+}
+
+// failed records a deployment that did not stabilize and exits. A shipped deployment has its version
+// parameter reverted, or is rolled back entirely when rollback is set.
+func (report *Report) failed(ctx context.Context, client *deployer.Client, err error, rollback bool) {
+	var rolloutFailedError *deployer.RolloutFailedError
+	rolledBackByECS := errors.As(err, &rolloutFailedError) && rolloutFailedError.RolledBack
+
+	// Interrupting the command must not leave the version parameter, the traffic or the service half restored
+	ctx, cancel := cleanupContext()
+	defer cancel()
+
+	// Traffic shifted to the idle service goes back to the live one, which still runs the previous version
+	if report.shift != nil && report.shift.Shifted > 0 {
+		rerr := client.RestoreTraffic(ctx, report.shift)
+		if rerr != nil {
+			report.fail(OutcomeDidNotStabilize, ExitDidNotStabilize, fmt.Errorf("%v; restoring traffic to %s failed: %v", err, report.shift.Live, rerr))
+		}
+		if report.Shift != nil {
+			report.Shift.Restored = true
+		}
+		report.fail(OutcomeRolledBack, ExitRolledBack, fmt.Errorf("%v; traffic restored to %s", err, report.shift.Live))
+	}
+
+	if report.plan == nil {
+		if rolledBackByECS {
+			report.fail(OutcomeRolledBack, ExitRolledBack, err)
+		}
+		report.fail(OutcomeDidNotStabilize, ExitDidNotStabilize, err)
+	}
+
+	// ECS or CodeDeploy already returned the service to its last completed deployment; only the version parameter is left
+	if rolledBackByECS {
+		if !report.plan.Options.SetVersionAfterStable {
+			rerr := client.RevertVersion(ctx, report.plan)
+			if rerr != nil {
+				err = fmt.Errorf("%v; reverting the version parameter failed: %v", err, rerr)
+			}
+		}
+		report.fail(OutcomeRolledBack, ExitRolledBack, err)
+	}
+
+	if !rollback {
+		// The deployment failed, so the version parameter must not claim it succeeded
+		if !report.plan.Options.SetVersionAfterStable {
+			rerr := client.RevertVersion(ctx, report.plan)
+			if rerr != nil {
+				err = fmt.Errorf("%v; reverting the version parameter failed: %v", err, rerr)
+			}
+		}
+		report.fail(OutcomeDidNotStabilize, ExitDidNotStabilize, err)
+	}
+
+	say("%v\nRolling back %s in %s\n", err, deploymentOptions.Application, deploymentOptions.Environment)
+	report.Rollback = &RollbackReport{}
+
+	// The service may be rolled back even though restoring the version parameter failed
+	results, rerr := client.RollbackPlan(ctx, report.plan)
+	if rerr != nil {
+		report.Rollback.Error = rerr.Error()
+		if results == nil {
+			report.fail(OutcomeDidNotStabilize, ExitDidNotStabilize, fmt.Errorf("%v; rollback failed: %v", err, rerr))
+		}
+	}
+	versionErr := rerr
+	report.Rollback.TaskDefinition = results.TaskDefinition
+
+	report.Rollback.Wait, rerr = wait(ctx, client, deploymentOptions, results, progress())
+	if rerr != nil {
+		report.Rollback.Error = rerr.Error()
+		report.fail(OutcomeDidNotStabilize, ExitDidNotStabilize, fmt.Errorf("%v; rolled back to %s but it did not stabilize: %v", err, results.TaskDefinition, rerr))
+	}
+
+	if versionErr != nil {
+		report.fail(OutcomeRolledBack, ExitRolledBack, fmt.Errorf("%v; rolled back to %s, version parameter not restored: %v", err, results.TaskDefinition, versionErr))
+	}
+	report.fail(OutcomeRolledBack, ExitRolledBack, fmt.Errorf("%v; rolled back to %s", err, results.TaskDefinition))
+}
+
+// cleanupContext is used to restore a failed deployment. The command's context may already be cancelled, so it
+// derives from the background context, bounded by cleanupTimeout; waiting for a rollback is bounded by MaxAttempts.
+func cleanupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), cleanupTimeout)
+}
+
+// lock takes the deployment lock on the service of depOpts, unless --no-lock or --dry-run is set, exiting when it cannot
+// be taken. Every lock taken is released when the report exits, including after an interrupt.
+func (report *Report) lock(ctx context.Context, client *deployer.Client, depOpts deployer.DeploymentOptions) {
+	if depOpts.NoLock || depOpts.DryRun {
+		return
+	}
+
+	lock, err := client.AcquireLock(ctx, depOpts)
+	var locked *deployer.LockedError
+	if errors.As(err, &locked) {
+		report.Lock = locked.Holder
+	}
+	if err != nil {
+		report.fail(OutcomeFailedToInvoke, ExitFailedToInvoke, err)
+	}
+
+	unlock := report.unlock
+	report.unlock = func() {
+		// The command's context may already be cancelled
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		err := client.ReleaseLock(ctx, lock)
+		if err != nil {
+			say("Releasing the deployment lock %s failed: %v\n", lock.Parameter, err)
+		}
+		if unlock != nil {
+			unlock()
+		}
+	}
+}
+
+// exit writes the report in structured output modes and exits with its exit code
+func (report *Report) exit() {
+	report.runExitHooks()
+	if report.unlock != nil {
+		report.unlock()
+	}
+
+	if outputFormat != outputText {
+		err := writeStructured(os.Stdout, outputFormat, report)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitError)
+		}
+	}
+	os.Exit(report.ExitCode)
+}
+
+// progress is where human readable progress is written. It is stderr in structured output
+// modes so stdout only carries the report.
+func progress() io.Writer {
+	if outputFormat == outputText {
+		return os.Stdout
+	}
+	return os.Stderr
+}
+
+func say(format string, a ...interface{}) {
+	fmt.Fprintf(progress(), format, a...)
+}
+
+func validateOutputFormat() error {
+	switch outputFormat {
+	case outputText, outputJSON, outputYAML:
+		return nil
+	}
+	return fmt.Errorf("invalid --output %q: must be one of text, json, yaml", outputFormat)
+}
+
+// writeStructured encodes v as json or yaml. YAML is produced from the JSON encoding so both
+// formats share the same field names and order.
+func writeStructured(w io.Writer, format string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if format == outputJSON {
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	}
+
+	// JSON is valid YAML; decoding into a node keeps key order
+	var node yaml.Node
+	err = yaml.Unmarshal(b, &node)
+	if err != nil {
+		return err
+	}
+	resetYAMLStyle(&node)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	err = enc.Encode(&node)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// resetYAMLStyle drops the flow and quoting styles inherited from JSON so the document renders as block YAML
+func resetYAMLStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, n := range node.Content {
+		resetYAMLStyle(n)
+	}
+}
@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/justmiles/ecs-deploy/src/deployer"
+	"github.com/spf13/cobra"
+)
+
+// planFileSchemaVersion is bumped whenever a field of planFile is removed or changes meaning
+const planFileSchemaVersion = 1
+
+var planOut string
+
+// planFile is a plan saved by plan, to be executed by apply
+type planFile struct {
+	SchemaVersion int `json:"SchemaVersion"`
+	// Created is when the plan was made
+	Created time.Time      `json:"Created"`
+	Plan    *deployer.Plan `json:"Plan"`
+	// Region the plan was made in. Default: the session's region
+	Region string `json:"Region,omitempty"`
+	// NoWait and RollbackOnFailure are the flags the plan was made with
+	NoWait            bool `json:"NoWait,omitempty"`
+	RollbackOnFailure bool `json:"RollbackOnFailure,omitempty"`
+	// Hooks of the manifest the plan was made from
+	Hooks *deployer.ManifestHooks `json:"Hooks,omitempty"`
+}
+
+func init() {
+	rootCmd.AddCommand(planCmd)
+
+	addShipFlags(planCmd)
+
+	addTargetFlags(planCmd)
+
+	planCmd.Flags().StringVar(&planOut, "out", "plan.json", "File the plan is saved to")
+}
+
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Save the changes ship would make to a plan file, to be executed by apply",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+		client := newClient()
+		report := newReport("plan")
+
+		prepareShip(ctx, cmd, client, report)
+		targets, err := parseTargets(client)
+		if err != nil {
+			report.fail(OutcomeFailedToInvoke, ExitError, err)
+		}
+		if strings.Contains(deploymentOptions.Application, ",") || len(targets) > 1 {
+			report.fail(OutcomeFailedToInvoke, ExitError, fmt.Errorf("a plan file holds a single service in a single cluster; plan each separately"))
+		}
+		client = targets[0].client
+
+		deploymentOptions.Role = targets[0].Role
+		deploymentOptions, err = serviceOptions(ctx, client, deploymentOptions)
+		if err != nil {
+			report.fail(OutcomeFailedToInvoke, ExitFailedToInvoke, err)
+		}
+		// The manifest's hooks run when the plan is applied
+		hooks := report.hooks
+		report.hooks = nil
+
+		say("\nPlanning %s in %s\n", shipped(deploymentOptions), deploymentOptions.Environment)
+		plan, err := client.PlanDeployment(ctx, deploymentOptions)
+		if err != nil {
+			report.fail(OutcomeFailedToInvoke, ExitFailedToInvoke, err)
+		}
+
+		if outputFormat == outputText {
+			fmt.Println(plan)
+		}
+
+		err = savePlan(planOut, &planFile{
+			SchemaVersion:     planFileSchemaVersion,
+			Created:           time.Now().UTC(),
+			Plan:              plan,
+			Region:            targets[0].Region,
+			NoWait:            noWait,
+			RollbackOnFailure: rollbackOnFailure,
+			Hooks:             hooks,
+		})
+		if err != nil {
+			report.fail(OutcomeFailedToInvoke, ExitError, err)
+		}
+		report.Results = &deployer.DeploymentResults{Plan: plan}
+		report.Outcome = OutcomePlanned
+		say("Plan saved to %s. Run \"ecs-deploy apply %s\" to execute it\n", planOut, planOut)
+		report.exit()
+	},
+}
+
+// savePlan writes a plan file
+func savePlan(path string, pf *planFile) error {
+	b, err := json.MarshalIndent(pf, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// loadPlan reads a plan file written by savePlan
+func loadPlan(path string) (*planFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pf := &planFile{}
+	err = json.Unmarshal(b, pf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid plan file %s: %v", path, err)
+	}
+	if pf.SchemaVersion != planFileSchemaVersion {
+		return nil, fmt.Errorf("invalid plan file %s: unsupported SchemaVersion %d, expected %d", path, pf.SchemaVersion, planFileSchemaVersion)
+	}
+	if pf.Plan == nil || pf.Plan.BaseTaskDefinition == nil || pf.Plan.TaskDefinition == nil || pf.Plan.ServiceUpdate == nil {
+		return nil, fmt.Errorf("invalid plan file %s: incomplete plan", path)
+	}
+	return pf, nil
+}
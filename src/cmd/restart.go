@@ -1,11 +1,8 @@
 package cmd
 
 import (
-	"encoding/json"
 	"fmt"
-	"os"
 
-	"github.com/justmiles/ecs-deploy/src/deployer"
 	"github.com/spf13/cobra"
 )
 
@@ -22,48 +19,31 @@ func init() {
 
 	restartCmd.Flags().IntVar(&deploymentOptions.MaxAttempts, "max-attempts", 40, "Number of attempts (with subsequent 15 sec pause) to wait for service to become stable")
 
+	restartCmd.Flags().IntVar(&deploymentOptions.FailureThreshold, "failure-threshold", 3, "Stop waiting once this many tasks of the new deployment have failed. 0 waits for --max-attempts regardless")
+
 	restartCmd.Flags().BoolVarP(&noWait, "no-wait", "w", false, "Redeploy and exit; Do not wait for service to reach stable state")
 
+	restartCmd.Flags().BoolVar(&deploymentOptions.SkipTargetHealth, "skip-target-health", false, "Treat a steady state as success without waiting for the new tasks to pass their load balancer health checks")
+
+	addLockFlags(restartCmd)
 }
 
 var restartCmd = &cobra.Command{
 	Use:   "restart",
 	Short: "gracefully restart/redeploy an application",
 	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+		client := newClient()
+		report := newReport("restart")
 
-		fmt.Printf("Redeploying %s in %s\n", deploymentOptions.Application, deploymentOptions.Environment)
-		results, err := deployer.PerformReDeployment(deploymentOptions)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-
-		if debugEnabled {
-			fmt.Println(results)
-		}
+		report.lock(ctx, client, deploymentOptions)
 
-		var depRes deployer.DeploymentResults
-		err = json.Unmarshal([]byte(results), &depRes)
+		say("Redeploying %s in %s\n", deploymentOptions.Application, deploymentOptions.Environment)
+		depRes, err := client.PerformReDeployment(ctx, deploymentOptions)
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-		if depRes.SuccessfullyInvoked {
-
-			if !noWait {
-				fmt.Println("Waiting for service to reach stable state")
-
-				err := deployer.WaitForDeployment(deploymentOptions)
-				if err != nil {
-					fmt.Println(err)
-					os.Exit(1)
-				}
-			}
-
-			fmt.Printf("%s successfully restarted in %s\n", deploymentOptions.Application, deploymentOptions.Environment)
-		} else {
-			fmt.Printf("Error pushing updates to %s\n", deploymentOptions.Environment)
+			report.fail(OutcomeFailedToInvoke, ExitFailedToInvoke, err)
 		}
 
+		report.succeed(ctx, client, depRes, fmt.Sprintf("%s successfully restarted in %s", deploymentOptions.Application, deploymentOptions.Environment))
 	},
 }
@@ -2,20 +2,88 @@ package cmd
 
 import (
 	"fmt"
+	"strings"
 
+	"github.com/justmiles/ecs-deploy/src/deployer"
 	"github.com/spf13/cobra"
 )
 
 func init() {
 	rootCmd.AddCommand(rollbackCmd)
-	rollbackCmd.PersistentFlags().StringP("application", "a", "YOUR NAME", "Author name for copyright attribution")
-	rollbackCmd.PersistentFlags().IntP("task-definition", "t", 0, "Override the task definition version")
+
+	rollbackCmd.Flags().StringVarP(&deploymentOptions.Application, "application", "a", "", "Application name to roll back, or a comma separated list of services to roll back together")
+	rollbackCmd.MarkFlagRequired("application")
+
+	rollbackCmd.Flags().StringVarP(&deploymentOptions.Environment, "environment", "e", "", "Target environment, or a comma separated list of environments")
+	rollbackCmd.MarkFlagRequired("environment")
+
+	rollbackCmd.Flags().StringVarP(&deploymentOptions.Role, "role", "r", "", "An IAM role ARN to assume before invoking a deployment.")
+
+	rollbackCmd.Flags().Int64VarP(&deploymentOptions.TaskDefinitionRevision, "task-definition", "t", 0, "Roll back to this revision of the service's task definition family. Default: the newest ACTIVE revision below the current one")
+
+	rollbackCmd.Flags().StringVar(&deploymentOptions.Container, "container", "", "Container whose image version the version parameter is restored to. Default: the first container in the task definition")
+
+	rollbackCmd.Flags().StringVar(&deploymentOptions.VersionParameter, "version-param", deployer.DefaultVersionParameter, "Template of the SSM parameter holding the desired version")
+
+	rollbackCmd.Flags().BoolVar(&deploymentOptions.NoVersionParameter, "no-version-param", false, "Do not restore the SSM version parameter")
+
+	rollbackCmd.Flags().IntVar(&deploymentOptions.MaxAttempts, "max-attempts", 40, "Number of attempts (with subsequent 15 sec pause) to wait for service to become stable")
+
+	rollbackCmd.Flags().IntVar(&deploymentOptions.FailureThreshold, "failure-threshold", 3, "Stop waiting once this many tasks of the new deployment have failed. 0 waits for --max-attempts regardless")
+
+	rollbackCmd.Flags().BoolVarP(&noWait, "no-wait", "w", false, "Roll back and exit; Do not wait for service to reach stable state")
+
+	rollbackCmd.Flags().BoolVar(&deploymentOptions.SkipTargetHealth, "skip-target-health", false, "Treat a steady state as success without waiting for the new tasks to pass their load balancer health checks")
+
+	rollbackCmd.Flags().StringVar(&deploymentOptions.CodeDeployApplication, "codedeploy-application", "", "CodeDeploy application of a CODE_DEPLOY service. Default: \"AppECS-<environment>-<application>\"")
+
+	rollbackCmd.Flags().StringVar(&deploymentOptions.CodeDeployDeploymentGroup, "codedeploy-deployment-group", "", "CodeDeploy deployment group of a CODE_DEPLOY service. Default: \"DgpECS-<environment>-<application>\"")
+
+	rollbackCmd.Flags().IntVar(&concurrency, "concurrency", 4, "When rolling back several services or targets, roll back at most this many at a time")
+
+	addTargetFlags(rollbackCmd)
+
+	addLockFlags(rollbackCmd)
 }
 
 var rollbackCmd = &cobra.Command{
 	Use:   "rollback",
 	Short: "Redeploy the previous task definition",
+	Long: `Redeploy the previous task definition of a service and restore the version parameter to its image version.
+
+Without --task-definition the service is rolled back to the newest ACTIVE revision of its task definition family below
+the one it runs. ECS does not record which revision a service ran before, so that is not necessarily the revision the
+service last ran: a revision registered by a deployment that failed before updating the service is chosen over it, and
+deregistered revisions are skipped. Pass --task-definition to roll back to a known revision.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("Hugo Static Site Generator v0.9 -- HEAD")
+		ctx := cmd.Context()
+		client := newClient()
+		report := newReport("rollback")
+
+		targets, err := parseTargets(client)
+		if err != nil {
+			report.fail(OutcomeFailedToInvoke, ExitError, err)
+		}
+		applications := strings.Split(deploymentOptions.Application, ",")
+		if len(applications) > 1 || len(targets) > 1 {
+			if deploymentOptions.TaskDefinitionRevision > 0 {
+				report.fail(OutcomeFailedToInvoke, ExitError, fmt.Errorf("--task-definition rolls back a single service"))
+			}
+			rollbackServices(ctx, report, targets, applications)
+		}
+		client = targets[0].client
+		deploymentOptions.Role = targets[0].Role
+
+		report.lock(ctx, client, deploymentOptions)
+
+		say("Rolling back %s in %s\n", deploymentOptions.Application, deploymentOptions.Environment)
+		depRes, err := client.PerformRollback(ctx, deploymentOptions)
+		if err != nil && depRes == nil {
+			report.fail(OutcomeFailedToInvoke, ExitFailedToInvoke, err)
+		}
+		// The service was rolled back even when restoring the version parameter failed
+		report.versionErr = err
+
+		report.succeed(ctx, client, depRes, fmt.Sprintf("%s successfully rolled back to %s in %s", deploymentOptions.Application, depRes.TaskDefinition, deploymentOptions.Environment))
 	},
 }
@@ -1,15 +1,20 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/justmiles/ecs-deploy/src/deployer"
 	"github.com/spf13/cobra"
 )
 
 var (
 	lambdaName   string
 	debugEnabled bool
+	outputFormat string
 )
 
 var rootCmd = &cobra.Command{
@@ -17,15 +22,37 @@ var rootCmd = &cobra.Command{
 	Short:   "Deploy something",
 	Long:    `A fast and flexible tool to deploy to Amazon Web Service's Elastic Container Service`,
 	Version: "0.7.3",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		err := validateOutputFormat()
+		if err != nil && cmd == planCmd {
+			// -o is the report format for every command, plan included
+			return fmt.Errorf("%v; the plan file is set with --out", err)
+		}
+		return err
+	},
 }
 
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
 		fmt.Println(err)
-		os.Exit(1)
+		os.Exit(ExitError)
+	}
+}
+
+// newClient builds a deployer client for the role in deploymentOptions, exiting on failure
+func newClient() *deployer.Client {
+	client, err := deployer.NewClient(deployer.WithRole(deploymentOptions.Role), deployer.WithOutput(progress()))
+	if err != nil {
+		fmt.Fprintln(progress(), err)
+		os.Exit(ExitError)
 	}
+	return client
 }
 
 func init() {
 	rootCmd.PersistentFlags().BoolVarP(&debugEnabled, "debug", "d", false, "Enable debug logging")
+	rootCmd.PersistentFlags().StringVarP(&outputFormat, "output", "o", outputText, "Output format: text, json or yaml. Structured formats write a single report to stdout and progress to stderr")
 }
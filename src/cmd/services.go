@@ -0,0 +1,615 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/justmiles/ecs-deploy/src/deployer"
+)
+
+// errSkipped is recorded for services left alone because another service failed first
+var errSkipped = errors.New("skipped: another service failed")
+
+// ServiceReport is the outcome for one service of a command run against several services or targets, e.g.
+// ship -a web,worker
+type ServiceReport struct {
+	Application string `json:"Application"`
+	Environment string `json:"Environment"`
+	Region      string `json:"Region,omitempty"`
+	// Outcome is one of: succeeded, dry-run, invoked (with --no-wait), failed to invoke, did not stabilize, rolled back
+	Outcome  string                      `json:"Outcome"`
+	Error    string                      `json:"Error,omitempty"`
+	Results  *deployer.DeploymentResults `json:"Results,omitempty"`
+	Wait     *WaitReport                 `json:"Wait,omitempty"`
+	Rollback *RollbackReport             `json:"Rollback,omitempty"`
+}
+
+// WaveReport is the outcome of one wave of a deployment fanned out to several targets
+type WaveReport struct {
+	// Targets deployed in the wave, e.g. prd@us-east-1
+	Targets []string `json:"Targets"`
+	// Gate is the check of the previous wave the wave waited for
+	Gate       *GateReport                `json:"Gate,omitempty"`
+	SmokeTests []deployer.SmokeTestResult `json:"SmokeTests,omitempty"`
+	Bake       *BakeReport                `json:"Bake,omitempty"`
+}
+
+// GateReport is the outcome of checking the services of a wave before deploying the next one
+type GateReport struct {
+	// Healthy is set when every service was stable, its targets healthy and no alarm in ALARM
+	Healthy  bool   `json:"Healthy"`
+	Duration string `json:"Duration"`
+	Error    string `json:"Error,omitempty"`
+}
+
+// serviceDeployment is one service, in one target, of a command run against several services or targets
+type serviceDeployment struct {
+	options deployer.DeploymentOptions
+	target  *target
+	// name identifies the service in progress, e.g. "web" or "prd@us-east-1 web"
+	name string
+	// client writes its progress to out, which prefixes every line with name
+	client *deployer.Client
+	out    io.Writer
+	plan   *deployer.Plan
+	err    error
+	report *ServiceReport
+}
+
+// fail records the error of the service
+func (s *serviceDeployment) fail(err error) {
+	s.err = err
+	s.report.Error = err.Error()
+}
+
+// newServiceDeployments prepares a serviceDeployment with deploymentOptions for each application in each target,
+// adding them to the report
+func newServiceDeployments(report *Report, targets []*target, applications []string) []*serviceDeployment {
+	mu := &sync.Mutex{}
+	var services []*serviceDeployment
+	for _, t := range targets {
+		for _, application := range applications {
+			options := deploymentOptions
+			options.Environment = t.Environment
+			options.Application = application
+			options.Role = t.Role
+
+			var name []string
+			if len(targets) > 1 {
+				name = append(name, t.name())
+			}
+			if len(applications) > 1 {
+				name = append(name, application)
+			}
+			out := &prefixWriter{mu: mu, w: progress(), prefix: fmt.Sprintf("[%s] ", strings.Join(name, " "))}
+
+			s := &serviceDeployment{
+				options: options,
+				target:  t,
+				name:    strings.Join(name, " "),
+				client:  t.client.Clone(deployer.WithOutput(out)),
+				out:     out,
+				report:  &ServiceReport{Application: application, Environment: t.Environment, Region: t.Region, Outcome: OutcomeFailedToInvoke},
+			}
+			services = append(services, s)
+			report.Services = append(report.Services, s.report)
+		}
+	}
+	return services
+}
+
+// lockServices takes the deployment lock of every service. Locks are taken in the same order by every command so two
+// commands run against overlapping services cannot each hold a lock the other is waiting for.
+func (report *Report) lockServices(ctx context.Context, services []*serviceDeployment) {
+	sorted := append([]*serviceDeployment{}, services...)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.target.Region != b.target.Region {
+			return a.target.Region < b.target.Region
+		}
+		if a.options.Environment != b.options.Environment {
+			return a.options.Environment < b.options.Environment
+		}
+		return a.options.Application < b.options.Application
+	})
+	for _, s := range sorted {
+		report.lock(ctx, s.client, s.options)
+	}
+}
+
+// forEachService runs fn for every service, at most limit at a time, and returns the error of each. Once one fails,
+// services not yet started are skipped with errSkipped.
+func forEachService(services []*serviceDeployment, limit int, fn func(*serviceDeployment) error) []error {
+	if limit <= 0 {
+		limit = len(services)
+	}
+
+	errs := make([]error, len(services))
+	var mu sync.Mutex
+	failed := false
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i, s := range services {
+		sem <- struct{}{}
+
+		mu.Lock()
+		skip := failed
+		mu.Unlock()
+		if skip {
+			<-sem
+			errs[i] = errSkipped
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, s *serviceDeployment) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := fn(s)
+			if err != nil {
+				mu.Lock()
+				errs[i] = err
+				failed = true
+				mu.Unlock()
+			}
+		}(i, s)
+	}
+	wg.Wait()
+	return errs
+}
+
+// recordErrors records the error of each service that failed, returning the first one other than errSkipped
+func recordErrors(services []*serviceDeployment, errs []error) error {
+	var first error
+	for i, s := range services {
+		if errs[i] == nil {
+			continue
+		}
+		s.fail(errs[i])
+		if first == nil && errs[i] != errSkipped {
+			first = fmt.Errorf("%s: %v", s.name, errs[i])
+		}
+	}
+	return first
+}
+
+// waitServices waits for every invoked service concurrently, returning the first that did not stabilize
+func waitServices(ctx context.Context, services []*serviceDeployment) error {
+	errs := forEachService(services, len(services), func(s *serviceDeployment) error {
+		var err error
+		s.report.Wait, err = wait(ctx, s.client, s.options, s.report.Results, s.out)
+		if err != nil {
+			return err
+		}
+		s.report.Outcome = OutcomeSucceeded
+		return nil
+	})
+	return recordErrors(services, errs)
+}
+
+// shipServices ships deploymentOptions.Version to each of applications in every target and exits. Every plan is built
+// and shown as one diff before anything changes. The waves are then deployed in turn: their services are updated at
+// most --concurrency at a time and waited on together, then smoke tested and baked. A wave only starts once every
+// service of the previous one is still stable and healthy.
+func shipServices(ctx context.Context, client *deployer.Client, report *Report, waves [][]*target, applications []string) {
+	if deploymentOptions.Canary > 0 {
+		report.fail(OutcomeFailedToInvoke, ExitError, fmt.Errorf("--canary ships one service to one target at a time"))
+	}
+	if noWait && len(waves) > 1 {
+		report.fail(OutcomeFailedToInvoke, ExitError, fmt.Errorf("--no-wait cannot gate the next wave on the previous one"))
+	}
+
+	var targets []*target
+	for _, wave := range waves {
+		targets = append(targets, wave...)
+	}
+	services := newServiceDeployments(report, targets, applications)
+
+	waveServices := make([][]*serviceDeployment, len(waves))
+	for i, wave := range waves {
+		for _, t := range wave {
+			for _, s := range services {
+				if s.target == t {
+					waveServices[i] = append(waveServices[i], s)
+				}
+			}
+		}
+	}
+
+	for _, s := range services {
+		var err error
+		s.options, err = serviceOptions(ctx, s.client, s.options)
+		if err != nil {
+			report.fail(OutcomeFailedToInvoke, ExitFailedToInvoke, fmt.Errorf("%s: %v", s.name, err))
+		}
+	}
+
+	report.lockServices(ctx, services)
+
+	say("\nDeploying %s@%s to %s\n", strings.Join(applications, ", "), deploymentOptions.Version, targetNames(targets))
+	errs := forEachService(services, concurrency, func(s *serviceDeployment) error {
+		var err error
+		s.plan, err = s.client.PlanDeployment(ctx, s.options)
+		return err
+	})
+	if err := recordErrors(services, errs); err != nil {
+		report.fail(OutcomeFailedToInvoke, ExitFailedToInvoke, err)
+	}
+
+	if outputFormat == outputText {
+		for _, s := range services {
+			fmt.Printf("\n# %s\n%s", s.name, s.plan)
+		}
+		fmt.Println()
+	}
+
+	if deploymentOptions.DryRun {
+		for _, s := range services {
+			s.report.Results = &deployer.DeploymentResults{Plan: s.plan}
+			s.report.Outcome = OutcomeDryRun
+		}
+		report.Outcome = OutcomeDryRun
+		report.exit()
+	}
+
+	report.runPreDeployHooks(ctx)
+
+	for i, wave := range waveServices {
+		// A single wave reports its smoke tests and bake at the top of the report
+		var waveReport *WaveReport
+		if len(waves) > 1 {
+			waveReport = &WaveReport{}
+			for _, t := range waves[i] {
+				waveReport.Targets = append(waveReport.Targets, t.name())
+			}
+			report.Waves = append(report.Waves, waveReport)
+
+			if i > 0 {
+				err := gate(ctx, waveServices[i-1], waveReport)
+				if err != nil {
+					report.failedServices(ctx, services, err, OutcomeDidNotStabilize, ExitDidNotStabilize, rollbackOnFailure)
+				}
+			}
+			say("\nWave %d of %d: %s\n", i+1, len(waves), targetNames(waves[i]))
+		}
+
+		errs = forEachService(wave, concurrency, func(s *serviceDeployment) error {
+			results, err := s.client.ApplyPlan(ctx, s.plan)
+			// The service was updated even when writing the version parameter failed, so it is rolled back with the others
+			if results != nil {
+				s.report.Results = results
+				s.report.Outcome = OutcomeInvoked
+			}
+			return err
+		})
+		if err := recordErrors(wave, errs); err != nil {
+			report.failedServices(ctx, services, err, OutcomeFailedToInvoke, ExitFailedToInvoke, rollbackOnFailure)
+		}
+
+		report.Outcome = OutcomeInvoked
+		if noWait {
+			break
+		}
+
+		err := waitServices(ctx, wave)
+		if err != nil {
+			report.failedServices(ctx, services, err, OutcomeDidNotStabilize, ExitDidNotStabilize, rollbackOnFailure)
+		}
+
+		if len(deploymentOptions.SmokeTests) > 0 {
+			say("Running %d smoke tests\n", len(deploymentOptions.SmokeTests))
+			results, err := client.RunSmokeTests(ctx, deploymentOptions)
+			if waveReport != nil {
+				waveReport.SmokeTests = results
+			} else {
+				report.SmokeTests = results
+			}
+			if err != nil {
+				for _, s := range wave {
+					s.fail(err)
+				}
+				report.failedServices(ctx, services, err, OutcomeDidNotStabilize, ExitDidNotStabilize, rollbackOnFailure)
+			}
+		}
+
+		if deploymentOptions.Bake > 0 {
+			bakeReport, err := bake(ctx, wave)
+			if waveReport != nil {
+				waveReport.Bake = bakeReport
+			} else {
+				report.Bake = bakeReport
+			}
+			if err != nil {
+				// A triggered alarm always rolls back
+				for _, s := range wave {
+					s.fail(err)
+				}
+				report.failedServices(ctx, services, err, OutcomeDidNotStabilize, ExitDidNotStabilize, true)
+			}
+		}
+	}
+
+	if !noWait {
+		report.Outcome = OutcomeSucceeded
+
+		for _, s := range services {
+			if s.plan.Options.SetVersionAfterStable {
+				err := s.client.PublishVersion(ctx, s.plan)
+				if err != nil {
+					report.fail(OutcomeSucceeded, ExitError, fmt.Errorf("%s is stable but setting the version parameter failed: %v", s.name, err))
+				}
+			}
+		}
+	}
+
+	say("%s@%s successfully updated in %s\n", strings.Join(applications, ", "), deploymentOptions.Version, targetNames(targets))
+	report.exit()
+}
+
+// gate holds for --wave-pause, then requires every service of the previous wave to still be stable, with healthy
+// load balancer targets and no --alarm in ALARM, recording the outcome in the next wave's report
+func gate(ctx context.Context, previous []*serviceDeployment, waveReport *WaveReport) error {
+	start := time.Now()
+	if wavePause > 0 {
+		say("Holding for %s before the next wave\n", wavePause)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wavePause):
+		}
+	}
+
+	say("Checking the previous wave is stable and healthy\n")
+	errs := forEachService(previous, len(previous), func(s *serviceDeployment) error {
+		return s.client.CheckHealthy(ctx, s.options)
+	})
+	err := recordErrors(previous, errs)
+
+	waveReport.Gate = &GateReport{
+		Healthy:  err == nil,
+		Duration: time.Since(start).Round(time.Second).String(),
+	}
+	if err != nil {
+		waveReport.Gate.Error = err.Error()
+	}
+	return err
+}
+
+// bake watches the alarms for the bake period in every target of the services, returning the first that went to
+// ALARM. The other targets stop baking once one fails.
+func bake(ctx context.Context, services []*serviceDeployment) (*BakeReport, error) {
+	if len(deploymentOptions.BakeAlarms) == 0 {
+		say("Holding for %s\n", time.Duration(deploymentOptions.Bake))
+	} else {
+		say("Baking for %s while watching alarms %s\n", time.Duration(deploymentOptions.Bake), strings.Join(deploymentOptions.BakeAlarms, ", "))
+	}
+
+	// Alarms are watched once per target, through the client of its first service
+	var watched []*serviceDeployment
+	seen := map[*target]bool{}
+	for _, s := range services {
+		if !seen[s.target] {
+			seen[s.target] = true
+			watched = append(watched, s)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := time.Now()
+	errs := forEachService(watched, len(watched), func(s *serviceDeployment) error {
+		err := s.client.Bake(ctx, deploymentOptions)
+		if err != nil {
+			cancel()
+		}
+		return err
+	})
+	bakeReport := &BakeReport{
+		Duration: time.Since(start).Round(time.Second).String(),
+		Alarms:   deploymentOptions.BakeAlarms,
+	}
+
+	var first error
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		var alarmError *deployer.AlarmError
+		if errors.As(err, &alarmError) {
+			bakeReport.Triggered = append(bakeReport.Triggered, alarmError.Alarms...)
+		}
+		// The other targets stop baking with context.Canceled once one fails
+		if first == nil || errors.Is(first, context.Canceled) && !errors.Is(err, context.Canceled) {
+			first = err
+			if len(watched) > 1 {
+				first = fmt.Errorf("%s: %w", watched[i].target.name(), err)
+			}
+		}
+	}
+	if first != nil {
+		bakeReport.Error = first.Error()
+	}
+	return bakeReport, first
+}
+
+// failedServices records a deployment of several services that failed with err and exits. Services not yet started
+// are skipped. With rollback, every service that was updated is rolled back. Otherwise only the services that failed
+// have their version parameter reverted, and the commands to roll back the updated services are printed.
+func (report *Report) failedServices(ctx context.Context, services []*serviceDeployment, err error, outcome string, exitCode int, rollback bool) {
+	// Interrupting the command must not leave the version parameters or the services half restored
+	ctx, cancel := cleanupContext()
+	defer cancel()
+
+	var updated []*serviceDeployment
+	for _, s := range services {
+		if s.report.Results != nil {
+			updated = append(updated, s)
+		} else if s.err == nil {
+			s.fail(errSkipped)
+		}
+	}
+
+	var toRollBack []*serviceDeployment
+	for _, s := range updated {
+		// ECS or CodeDeploy already returned the service to its last completed deployment
+		var rolloutFailedError *deployer.RolloutFailedError
+		if errors.As(s.err, &rolloutFailedError) && rolloutFailedError.RolledBack {
+			s.report.Outcome = OutcomeRolledBack
+		} else if rollback {
+			toRollBack = append(toRollBack, s)
+			continue
+		} else if s.err != nil {
+			s.report.Outcome = OutcomeDidNotStabilize
+		} else {
+			continue
+		}
+
+		// The deployment failed, so the version parameter must not claim it succeeded
+		if !s.plan.Options.SetVersionAfterStable {
+			rerr := s.client.RevertVersion(ctx, s.plan)
+			if rerr != nil {
+				s.report.Error = fmt.Sprintf("%s; reverting the version parameter failed: %v", s.report.Error, rerr)
+			}
+		}
+	}
+
+	if len(toRollBack) > 0 {
+		say("%v\nRolling back %s\n", err, serviceNames(toRollBack))
+		errs := forEachService(toRollBack, len(toRollBack), func(s *serviceDeployment) error {
+			s.report.Rollback = &RollbackReport{}
+			// The service may be rolled back even though restoring the version parameter failed
+			results, versionErr := s.client.RollbackPlan(ctx, s.plan)
+			if versionErr != nil {
+				s.report.Rollback.Error = versionErr.Error()
+				if results == nil {
+					s.report.Outcome = OutcomeDidNotStabilize
+					return versionErr
+				}
+			}
+			s.report.Rollback.TaskDefinition = results.TaskDefinition
+
+			var err error
+			s.report.Rollback.Wait, err = wait(ctx, s.client, s.options, results, s.out)
+			if err != nil {
+				s.report.Rollback.Error = err.Error()
+				s.report.Outcome = OutcomeDidNotStabilize
+				return err
+			}
+			s.report.Outcome = OutcomeRolledBack
+			return nil
+		})
+		for i, s := range toRollBack {
+			if errs[i] != nil {
+				report.fail(OutcomeDidNotStabilize, ExitDidNotStabilize, fmt.Errorf("%v; rolling back %s failed: %v", err, s.name, errs[i]))
+			}
+		}
+		// A service rolled back with a rollback error only failed to restore its version parameter
+		var notRestored []string
+		for _, s := range toRollBack {
+			if s.report.Rollback.Error != "" {
+				notRestored = append(notRestored, s.report.Rollback.Error)
+			}
+		}
+		if len(notRestored) > 0 {
+			report.fail(OutcomeRolledBack, ExitRolledBack, fmt.Errorf("%v; rolled back %s, version parameter not restored: %s", err, serviceNames(toRollBack), strings.Join(notRestored, "; ")))
+		}
+		report.fail(OutcomeRolledBack, ExitRolledBack, fmt.Errorf("%v; rolled back %s", err, serviceNames(toRollBack)))
+	}
+
+	if len(updated) > 0 {
+		say("Roll back every updated service with:\n")
+		for _, command := range rollbackCommands(updated) {
+			say("  %s\n", command)
+		}
+	}
+	report.fail(outcome, exitCode, err)
+}
+
+// rollbackServices rolls each of applications in every target back to its previous task definition, at most
+// --concurrency at a time, waits for them together and exits
+func rollbackServices(ctx context.Context, report *Report, targets []*target, applications []string) {
+	services := newServiceDeployments(report, targets, applications)
+	report.lockServices(ctx, services)
+
+	say("Rolling back %s in %s\n", strings.Join(applications, ", "), targetNames(targets))
+	errs := forEachService(services, concurrency, func(s *serviceDeployment) error {
+		results, err := s.client.PerformRollback(ctx, s.options)
+		// The service was rolled back even when restoring the version parameter failed
+		if results != nil {
+			s.report.Results = results
+			s.report.Outcome = OutcomeInvoked
+		}
+		return err
+	})
+	if err := recordErrors(services, errs); err != nil {
+		report.fail(OutcomeFailedToInvoke, ExitFailedToInvoke, err)
+	}
+
+	report.Outcome = OutcomeInvoked
+	if !noWait {
+		err := waitServices(ctx, services)
+		if err != nil {
+			report.fail(OutcomeDidNotStabilize, ExitDidNotStabilize, err)
+		}
+		report.Outcome = OutcomeSucceeded
+	}
+
+	say("%s successfully rolled back in %s\n", strings.Join(applications, ", "), targetNames(targets))
+	report.exit()
+}
+
+// serviceNames lists the services, e.g. "web, worker"
+func serviceNames(services []*serviceDeployment) string {
+	var names []string
+	for _, s := range services {
+		names = append(names, s.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// targetNames lists the targets, e.g. "prd@us-east-1, prd@eu-west-1"
+func targetNames(targets []*target) string {
+	var names []string
+	for _, t := range targets {
+		names = append(names, t.name())
+	}
+	return strings.Join(names, ", ")
+}
+
+// prefixWriter prefixes every line written to it, so the progress of services deployed concurrently can be told
+// apart. Writers sharing mu never interleave within a line.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	// Partial lines are held until they are complete
+	pw.buf = append(pw.buf, p...)
+	for {
+		i := bytes.IndexByte(pw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		_, err := fmt.Fprintf(pw.w, "%s%s", pw.prefix, pw.buf[:i+1])
+		pw.buf = pw.buf[i+1:]
+		if err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/justmiles/ecs-deploy/src/deployer"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(shiftCmd)
+
+	shiftCmd.Flags().StringVarP(&deploymentOptions.Application, "application", "a", "", "Application name; its services are <application>-blue and <application>-green unless --services is set")
+	shiftCmd.MarkFlagRequired("application")
+
+	shiftCmd.Flags().StringVarP(&deploymentOptions.Version, "version", "v", "", "Desired version of application")
+	shiftCmd.MarkFlagRequired("version")
+
+	shiftCmd.Flags().StringVarP(&deploymentOptions.Environment, "environment", "e", "", "Target environment for deployment")
+	shiftCmd.MarkFlagRequired("environment")
+
+	shiftCmd.Flags().StringVar(&deploymentOptions.Container, "container", "", "Name of the container to update. Default: the first container in the task definition")
+
+	shiftCmd.Flags().StringToStringVar(&deploymentOptions.Images, "image", map[string]string{}, "Set a container's version as <container>=<version>. Repeat to update several containers in one revision")
+
+	shiftCmd.Flags().StringVarP(&deploymentOptions.Role, "role", "r", "", "An IAM role ARN to assume before invoking a deployment.")
+
+	shiftCmd.Flags().StringSliceVar(&deploymentOptions.ShiftServices, "services", nil, "The two services traffic is shifted between. Default: <application>-blue,<application>-green")
+
+	shiftCmd.Flags().Int64SliceVar(&deploymentOptions.ShiftSteps, "steps", []int64{10, 50, 100}, "Percentages of traffic shifted to the idle service, in order")
+
+	shiftCmd.Flags().DurationVar((*time.Duration)(&deploymentOptions.ShiftPause), "pause", time.Minute, "How long to wait after each step before checking target health and alarms")
+
+	shiftCmd.Flags().StringVar(&deploymentOptions.ShiftListenerRule, "listener-rule", "", "ARN of the listener rule splitting traffic between the services. Default: discovered from their target groups")
+
+	shiftCmd.Flags().StringArrayVar(&deploymentOptions.BakeAlarms, "alarm", []string{}, "CloudWatch alarm checked after every step and during --bake. Repeat to watch several alarms")
+
+	shiftCmd.Flags().DurationVar((*time.Duration)(&deploymentOptions.Bake), "bake", 0, "Once all traffic is shifted, watch the --alarm alarms for this long and shift it back if any goes to ALARM")
+
+	shiftCmd.Flags().IntVar(&deploymentOptions.MaxAttempts, "max-attempts", 40, "Number of attempts (with subsequent 15 sec pause) to wait for the idle service to become stable")
+
+	shiftCmd.Flags().IntVar(&deploymentOptions.FailureThreshold, "failure-threshold", 3, "Stop waiting once this many tasks of the new deployment have failed. 0 waits for --max-attempts regardless")
+
+	shiftCmd.Flags().BoolVar(&rollbackOnFailure, "rollback-on-failure", false, "When the idle service does not stabilize, restore its previous task definition and wait for it")
+
+	shiftCmd.Flags().StringArrayVar(&smokeTests, "smoke-test", []string{}, "HTTP check run once the idle service is stable, before traffic shifts, as URL[,status=200][,body=REGEXP][,timeout=10s]. Repeat for several checks")
+
+	shiftCmd.Flags().BoolVar(&deploymentOptions.SkipTargetHealth, "skip-target-health", false, "Treat a steady state as success without waiting for the new tasks to pass their load balancer health checks")
+
+	shiftCmd.Flags().StringVar(&deploymentOptions.VersionParameter, "version-param", deployer.DefaultVersionParameter, "Template of the SSM parameter holding the desired version")
+
+	shiftCmd.Flags().BoolVar(&deploymentOptions.NoVersionParameter, "no-version-param", false, "Do not read or write the SSM version parameter")
+
+	shiftCmd.Flags().BoolVar(&deploymentOptions.SkipImageCheck, "skip-image-check", false, "Do not verify that ECR images exist before registering the new task definition")
+
+	shiftCmd.Flags().BoolVar(&deploymentOptions.DryRun, "dry-run", false, "Show changes without modifying resources.")
+
+	shiftCmd.Flags().BoolVar(&deploymentOptions.FullDiff, "full-diff", false, "Show every task and container definition field in the diff, not only the changed ones")
+
+	addLockFlags(shiftCmd)
+}
+
+var shiftCmd = &cobra.Command{
+	Use:   "shift",
+	Short: "Ship to the idle service of a blue/green pair and shift traffic to it",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+		client := newClient()
+		report := newReport("shift")
+
+		err := parseSmokeTests()
+		if err != nil {
+			report.fail(OutcomeFailedToInvoke, ExitError, err)
+		}
+
+		// Both services are locked before either is inspected, so a concurrent ship or shift cannot change which one is
+		// idle. They are locked in order, like lockServices, so two shifts of the pair cannot each hold one lock.
+		services := append([]string{}, deployer.ShiftServices(deploymentOptions)...)
+		sort.Strings(services)
+		for _, service := range services {
+			lockOptions := deploymentOptions
+			lockOptions.Application = service
+			report.lock(ctx, client, lockOptions)
+		}
+
+		target, err := client.PlanShift(ctx, deploymentOptions)
+		if err != nil {
+			report.fail(OutcomeFailedToInvoke, ExitFailedToInvoke, err)
+		}
+
+		// Everything from here on targets the idle service; the version parameter is only written once traffic has shifted
+		deploymentOptions, err = target.IdleOptions(deploymentOptions)
+		if err != nil {
+			report.fail(OutcomeFailedToInvoke, ExitFailedToInvoke, err)
+		}
+		deploymentOptions.SetVersionAfterStable = true
+
+		say("\nDeploying %s@%s to idle service %s in %s (live: %s)\n", report.Application, deploymentOptions.Version, target.Idle, deploymentOptions.Environment, target.Live)
+		plan, err := client.PlanDeployment(ctx, deploymentOptions)
+		if err != nil {
+			report.fail(OutcomeFailedToInvoke, ExitFailedToInvoke, err)
+		}
+
+		if outputFormat == outputText {
+			fmt.Println(plan)
+		}
+
+		if deploymentOptions.DryRun {
+			report.Results = &deployer.DeploymentResults{Plan: plan}
+			report.Outcome = OutcomeDryRun
+			report.exit()
+		}
+
+		depRes, err := client.ApplyPlan(ctx, plan)
+		if err != nil && depRes == nil {
+			report.fail(OutcomeFailedToInvoke, ExitFailedToInvoke, err)
+		}
+		// The service was updated even when writing the version parameter failed
+		report.versionErr = err
+		report.plan = plan
+		report.shift = target
+
+		report.succeed(ctx, client, depRes, fmt.Sprintf("%s@%s successfully shifted to %s in %s", report.Application, deploymentOptions.Version, target.Idle, deploymentOptions.Environment))
+	},
+}
@@ -1,9 +1,12 @@
 package cmd
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/justmiles/ecs-deploy/src/deployer"
 	"github.com/spf13/cobra"
@@ -12,6 +15,11 @@ import (
 var (
 	noWait            bool
 	ignoreTags        bool
+	rollbackOnFailure bool
+	canary            string
+	smokeTests        []string
+	manifestFile      string
+	concurrency       int
 	deploymentOptions = deployer.DeploymentOptions{
 		Description: "Desired version set by ecs-deploy CLI",
 	}
@@ -20,81 +28,274 @@ var (
 func init() {
 	rootCmd.AddCommand(shipCmd)
 
-	shipCmd.Flags().StringVarP(&deploymentOptions.Application, "application", "a", "", "Application name to deploy")
-	shipCmd.MarkFlagRequired("application")
+	addShipFlags(shipCmd)
 
-	shipCmd.Flags().StringVarP(&deploymentOptions.Version, "version", "v", "", "Desired version of application")
-	shipCmd.MarkFlagRequired("version")
+	shipCmd.Flags().BoolVar(&deploymentOptions.DryRun, "dry-run", false, "Show changes without modifying resources.")
 
-	shipCmd.Flags().StringVarP(&deploymentOptions.Environment, "environment", "e", "", "Target environment for deployment")
-	shipCmd.MarkFlagRequired("environment")
+	shipCmd.Flags().IntVar(&concurrency, "concurrency", 4, "When shipping several services or targets, e.g. -a web,worker, plan and update at most this many at a time")
 
-	shipCmd.Flags().StringVarP(&deploymentOptions.Role, "role", "r", "", "An IAM role ARN to assume before invoking a deployment.")
+	addTargetFlags(shipCmd)
 
-	shipCmd.Flags().IntVar(&deploymentOptions.MaxAttempts, "max-attempts", 40, "Number of attempts (with subsequent 15 sec pause) to wait for service to become stable")
+	shipCmd.Flags().StringArrayVar(&waveSpecs, "wave", []string{}, "Targets to deploy together, as a comma separated list of environments, regions or <environment>@<region>. Repeat for each wave, in order; other targets are deployed in a last wave")
 
-	shipCmd.Flags().BoolVarP(&noWait, "no-wait", "w", false, "Deploy and exit; Do not wait for service to reach stable state")
+	shipCmd.Flags().DurationVar(&wavePause, "wave-pause", 0, "Pause between waves before checking the previous wave is still stable and healthy")
 
-	shipCmd.Flags().BoolVar(&deploymentOptions.RefreshSecrets, "refresh-secrets", false, "Replace task defintion secrets with all ssm paramters with a prefix matching the 'secrets-prefix'")
+	addLockFlags(shipCmd)
+}
 
-	shipCmd.Flags().BoolVar(&deploymentOptions.DryRun, "dry-run", false, "Show changes without modifying resources.")
+// addShipFlags adds the flags a deployment is planned from, shared by ship and plan
+func addShipFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&deploymentOptions.Application, "application", "a", "", "Application name to deploy, or a comma separated list of services to ship the same version to. Required unless set by --file")
+
+	cmd.Flags().StringVarP(&deploymentOptions.Version, "version", "v", "", "Desired version of application. Required unless every container is set with --image")
+
+	cmd.Flags().StringVarP(&deploymentOptions.Environment, "environment", "e", "", "Target environment for deployment")
+	cmd.MarkFlagRequired("environment")
+
+	cmd.Flags().StringVarP(&manifestFile, "file", "f", "", "Deployment manifest (ecs-deploy.yaml) to apply, with the overlay for --environment. Flags take precedence over the manifest")
+
+	cmd.Flags().StringVar(&deploymentOptions.Container, "container", "", "Name of the container to update. Default: the first container in the task definition")
+
+	cmd.Flags().StringToStringVar(&deploymentOptions.Images, "image", map[string]string{}, "Set a container's version as <container>=<version>. Repeat to update several containers in one revision")
+
+	cmd.Flags().StringVarP(&deploymentOptions.Role, "role", "r", "", "An IAM role ARN to assume before invoking a deployment.")
+
+	cmd.Flags().IntVar(&deploymentOptions.MaxAttempts, "max-attempts", 40, "Number of attempts (with subsequent 15 sec pause) to wait for service to become stable")
+
+	cmd.Flags().IntVar(&deploymentOptions.FailureThreshold, "failure-threshold", 3, "Stop waiting once this many tasks of the new deployment have failed. 0 waits for --max-attempts regardless")
+
+	cmd.Flags().BoolVarP(&noWait, "no-wait", "w", false, "Deploy and exit; Do not wait for service to reach stable state")
+
+	cmd.Flags().BoolVar(&rollbackOnFailure, "rollback-on-failure", false, "When the service does not stabilize, restore the previous task definition and VERSION parameter and wait for it")
+
+	cmd.Flags().StringArrayVar(&smokeTests, "smoke-test", []string{}, "HTTP check run once the service is stable, as URL[,status=200][,body=REGEXP][,timeout=10s]. Repeat for several checks; any failure fails the deployment")
+
+	cmd.Flags().BoolVar(&deploymentOptions.SkipTargetHealth, "skip-target-health", false, "Treat a steady state as success without waiting for the new tasks to pass their load balancer health checks")
+
+	cmd.Flags().StringVar(&deploymentOptions.VersionParameter, "version-param", deployer.DefaultVersionParameter, "Template of the SSM parameter holding the desired version")
+
+	cmd.Flags().BoolVar(&deploymentOptions.NoVersionParameter, "no-version-param", false, "Do not read or write the SSM version parameter")
+
+	cmd.Flags().BoolVar(&deploymentOptions.SetVersionAfterStable, "version-param-after-stable", false, "Write the SSM version parameter only once the service is stable, rather than once the service update is accepted")
+
+	cmd.Flags().DurationVar((*time.Duration)(&deploymentOptions.Bake), "bake", 0, "Once the service is stable, watch the --alarm alarms for this long and roll back if any goes to ALARM")
+
+	cmd.Flags().StringArrayVar(&deploymentOptions.BakeAlarms, "alarm", []string{}, "CloudWatch alarm to watch during --bake. Repeat to watch several alarms")
+
+	cmd.Flags().Bool("circuit-breaker", false, "Enable or disable the ECS deployment circuit breaker. Default: unchanged")
 
-	shipCmd.Flags().StringSliceVarP(&deploymentOptions.SecretsPrefix, "secrets-prefix", "p", []string{}, "The ssm parameter store prefix to pull secrets from. Default: \"/<environment>/<application>/\"")
+	cmd.Flags().Bool("circuit-breaker-rollback", false, "Let ECS roll back deployments tripped by the circuit breaker. Default: unchanged")
 
-	shipCmd.Flags().BoolVarP(&ignoreTags, "ignore-tags", "i", false, "When present, this will ignore any parameters defined by ecs service tags.")
+	cmd.Flags().StringArrayVar(&deploymentOptions.DeploymentAlarms, "deployment-alarm", nil, "CloudWatch alarm ECS monitors during the deployment. Repeat for several alarms; pass \"\" to disable deployment alarms. Default: unchanged")
+
+	cmd.Flags().Bool("deployment-alarms-rollback", false, "Let ECS roll back deployments when a deployment alarm triggers. Default: unchanged")
+
+	cmd.Flags().StringVar(&deploymentOptions.CodeDeployApplication, "codedeploy-application", "", "CodeDeploy application of a CODE_DEPLOY service. Default: \"AppECS-<environment>-<application>\"")
+
+	cmd.Flags().StringVar(&deploymentOptions.CodeDeployDeploymentGroup, "codedeploy-deployment-group", "", "CodeDeploy deployment group of a CODE_DEPLOY service. Default: \"DgpECS-<environment>-<application>\"")
+
+	cmd.Flags().StringVar(&canary, "canary", "", "For services with the EXTERNAL deployment controller, start the new task set at this percentage of the desired count, e.g. 10%, and promote it once stable and baked")
+
+	cmd.Flags().BoolVar(&deploymentOptions.RefreshSecrets, "refresh-secrets", false, "Replace task defintion secrets with all ssm paramters with a prefix matching the 'secrets-prefix'")
+
+	cmd.Flags().BoolVar(&deploymentOptions.SkipImageCheck, "skip-image-check", false, "Do not verify that ECR images exist before registering the new task definition")
+
+	cmd.Flags().BoolVar(&deploymentOptions.FullDiff, "full-diff", false, "Show every task and container definition field in the diff, not only the changed ones")
+
+	cmd.Flags().StringSliceVarP(&deploymentOptions.SecretsPrefix, "secrets-prefix", "p", []string{}, "The ssm parameter store prefix to pull secrets from. Default: \"/<environment>/<application>/\"")
+
+	cmd.Flags().BoolVarP(&ignoreTags, "ignore-tags", "i", false, "When present, this will ignore any parameters defined by ecs service tags.")
 }
 
 var shipCmd = &cobra.Command{
 	Use:   "ship",
 	Short: "Ship an application to ECS",
 	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+		client := newClient()
+		report := newReport("ship")
 
-		if !ignoreTags {
-			err := deploymentOptions.SetDeploymentOptionsByEcsServiceTags()
+		prepareShip(ctx, cmd, client, report)
 
+		targets, err := parseTargets(client)
+		if err != nil {
+			report.fail(OutcomeFailedToInvoke, ExitError, err)
+		}
+		applications := strings.Split(deploymentOptions.Application, ",")
+		if len(applications) > 1 || len(targets) > 1 {
+			waves, err := buildWaves(targets, waveSpecs)
 			if err != nil {
-				fmt.Println(err)
-				os.Exit(1)
+				report.fail(OutcomeFailedToInvoke, ExitError, err)
 			}
+			shipServices(ctx, client, report, waves, applications)
 		}
+		client = targets[0].client
 
-		if len(deploymentOptions.SecretsPrefix) == 0 {
-			deploymentOptions.SecretsPrefix = []string{fmt.Sprintf("/%s/%s", deploymentOptions.Environment, deploymentOptions.Application)}
+		deploymentOptions.Role = targets[0].Role
+		deploymentOptions, err = serviceOptions(ctx, client, deploymentOptions)
+		if err != nil {
+			report.fail(OutcomeFailedToInvoke, ExitFailedToInvoke, err)
 		}
 
-		fmt.Printf("\nDeploying %s@%s to %s\n", deploymentOptions.Application, deploymentOptions.Version, deploymentOptions.Environment)
-		results, err := deployer.PerformDeployment(deploymentOptions)
+		report.lock(ctx, client, deploymentOptions)
+
+		say("\nDeploying %s to %s\n", shipped(deploymentOptions), deploymentOptions.Environment)
+		plan, err := client.PlanDeployment(ctx, deploymentOptions)
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			report.fail(OutcomeFailedToInvoke, ExitFailedToInvoke, err)
 		}
 
-		if debugEnabled {
-			fmt.Println(results)
+		if outputFormat == outputText {
+			fmt.Println(plan)
 		}
 
-		var depRes deployer.DeploymentResults
-		err = json.Unmarshal([]byte(results), &depRes)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+		if deploymentOptions.DryRun {
+			report.Results = &deployer.DeploymentResults{Plan: plan}
+			report.Outcome = OutcomeDryRun
+			report.exit()
+		}
+
+		report.runPreDeployHooks(ctx)
+
+		depRes, err := client.ApplyPlan(ctx, plan)
+		if err != nil && depRes == nil {
+			report.fail(OutcomeFailedToInvoke, ExitFailedToInvoke, err)
 		}
-		if depRes.SuccessfullyInvoked {
+		// The service was updated even when writing the version parameter failed
+		report.versionErr = err
+		report.plan = plan
 
-			if !noWait {
-				fmt.Println("Waiting for service to reach stable state")
+		report.succeed(ctx, client, depRes, fmt.Sprintf("%s successfully updated in %s", shipped(deploymentOptions), deploymentOptions.Environment))
+	},
+}
+
+// prepareShip completes deploymentOptions for ship and plan from the manifest and the flags, exiting with ExitError when
+// they are invalid
+func prepareShip(ctx context.Context, cmd *cobra.Command, client *deployer.Client, report *Report) {
+	if manifestFile != "" {
+		spec, err := applyManifest(cmd, manifestFile)
+		if err != nil {
+			report.fail(OutcomeFailedToInvoke, ExitError, err)
+		}
+		report.Application = deploymentOptions.Application
+		report.hooks = &spec.Hooks
+	}
+	if manifestFile != "" && strings.Contains(deploymentOptions.Environment, ",") {
+		report.fail(OutcomeFailedToInvoke, ExitError, fmt.Errorf("--file applies the overlay of a single environment; list regions in the manifest to deploy it to several"))
+	}
+	if deploymentOptions.Application == "" {
+		report.fail(OutcomeFailedToInvoke, ExitError, fmt.Errorf("--application is required unless set by --file"))
+	}
 
-				err := deployer.WaitForDeployment(deploymentOptions)
-				if err != nil {
-					fmt.Println(err)
-					os.Exit(1)
-				}
+	if deploymentOptions.Version == "" {
+		if len(deploymentOptions.Images) == 0 {
+			report.fail(OutcomeFailedToInvoke, ExitError, fmt.Errorf("--version is required unless --image is set"))
+		}
+		for name, version := range deploymentOptions.Images {
+			if version == "" {
+				report.fail(OutcomeFailedToInvoke, ExitError, fmt.Errorf("--version is required for container %s, which the manifest sets to the version being shipped", name))
 			}
+		}
+		// Without --version there is no single version of the application to record
+		deploymentOptions.NoVersionParameter = true
+	}
+
+	err := parseSmokeTests()
+	if err != nil {
+		report.fail(OutcomeFailedToInvoke, ExitError, err)
+	}
 
-			fmt.Printf("%s@%s successfully updated in %s\n", deploymentOptions.Application, deploymentOptions.Version, deploymentOptions.Environment)
-		} else {
-			fmt.Printf("Error pushing updates to %s\n", deploymentOptions.Environment)
+	if canary != "" {
+		deploymentOptions.Canary, err = parsePercent(canary)
+		if err != nil {
+			report.fail(OutcomeFailedToInvoke, ExitError, fmt.Errorf("invalid --canary: %v", err))
+		}
+		// The canary is only promoted, or removed, while waiting on it
+		if noWait {
+			report.fail(OutcomeFailedToInvoke, ExitError, fmt.Errorf("--canary cannot be used with --no-wait"))
 		}
+	}
 
-	},
+	// Without waiting, nothing would write the version parameter
+	if noWait && deploymentOptions.SetVersionAfterStable {
+		report.fail(OutcomeFailedToInvoke, ExitError, fmt.Errorf("--version-param-after-stable cannot be used with --no-wait"))
+	}
+
+	// Smoke tests and the bake period gate the deployment, so they cannot be skipped by not waiting on it
+	if noWait && len(deploymentOptions.SmokeTests) > 0 {
+		report.fail(OutcomeFailedToInvoke, ExitError, fmt.Errorf("--smoke-test cannot be used with --no-wait"))
+	}
+	if noWait && deploymentOptions.Bake > 0 {
+		report.fail(OutcomeFailedToInvoke, ExitError, fmt.Errorf("--bake cannot be used with --no-wait"))
+	}
+
+	// A canary may hold for the bake period without alarms
+	if deploymentOptions.Bake > 0 && len(deploymentOptions.BakeAlarms) == 0 && canary == "" {
+		report.fail(OutcomeFailedToInvoke, ExitError, fmt.Errorf("--bake requires at least one --alarm"))
+	}
+
+	// Unset booleans leave the service's deployment configuration unchanged
+	for flag, value := range map[string]**bool{
+		"circuit-breaker":            &deploymentOptions.CircuitBreaker,
+		"circuit-breaker-rollback":   &deploymentOptions.CircuitBreakerRollback,
+		"deployment-alarms-rollback": &deploymentOptions.DeploymentAlarmsRollback,
+	} {
+		if cmd.Flags().Changed(flag) {
+			b, _ := cmd.Flags().GetBool(flag)
+			*value = &b
+		}
+	}
+}
+
+// shipped describes what depOpts ships: <application>@<version>, or the version of each --image container when no
+// --version is given
+func shipped(depOpts deployer.DeploymentOptions) string {
+	if depOpts.Version != "" || len(depOpts.Images) == 0 {
+		return fmt.Sprintf("%s@%s", depOpts.Application, depOpts.Version)
+	}
+	var images []string
+	for name, version := range depOpts.Images {
+		images = append(images, name+"="+version)
+	}
+	sort.Strings(images)
+	return fmt.Sprintf("%s (%s)", depOpts.Application, strings.Join(images, ", "))
+}
+
+// serviceOptions completes depOpts from the tags of its service, unless --ignore-tags is set
+func serviceOptions(ctx context.Context, client *deployer.Client, depOpts deployer.DeploymentOptions) (deployer.DeploymentOptions, error) {
+	if !ignoreTags {
+		err := client.SetDeploymentOptionsByEcsServiceTags(ctx, &depOpts)
+		if err != nil {
+			return depOpts, err
+		}
+	}
+
+	if len(depOpts.SecretsPrefix) == 0 {
+		depOpts.SecretsPrefix = []string{fmt.Sprintf("/%s/%s", depOpts.Environment, depOpts.Application)}
+	}
+	return depOpts, nil
+}
+
+// parseSmokeTests appends the --smoke-test checks to deploymentOptions
+func parseSmokeTests() error {
+	for _, s := range smokeTests {
+		smokeTest, err := deployer.ParseSmokeTest(s)
+		if err != nil {
+			return fmt.Errorf("invalid --smoke-test: %v", err)
+		}
+		deploymentOptions.SmokeTests = append(deploymentOptions.SmokeTests, smokeTest)
+	}
+	return nil
+}
+
+// parsePercent parses a percentage such as "10%" or "10"
+func parsePercent(s string) (float64, error) {
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil {
+		return 0, err
+	}
+	if percent <= 0 || percent > 100 {
+		return 0, fmt.Errorf("%s is not between 0%% and 100%%", s)
+	}
+	return percent, nil
 }
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/justmiles/ecs-deploy/src/deployer"
+	"github.com/spf13/cobra"
+)
+
+var (
+	regions     []string
+	targetRoles map[string]string
+	waveSpecs   []string
+	wavePause   time.Duration
+)
+
+// target is an ECS cluster, named after its environment, in a region
+type target struct {
+	Environment string
+	// Region is empty for the session's region
+	Region string
+	Role   string
+	client *deployer.Client
+}
+
+// name is the environment, with the region when one was given, e.g. prd@eu-west-1
+func (t *target) name() string {
+	if t.Region == "" {
+		return t.Environment
+	}
+	return t.Environment + "@" + t.Region
+}
+
+// matches reports whether a --wave or --target-role selector names the target, its environment or its region
+func (t *target) matches(selector string) bool {
+	return selector == t.name() || selector == t.Environment || selector == t.Region
+}
+
+// addTargetFlags adds the flags fanning a command out to several clusters and regions
+func addTargetFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSliceVar(&regions, "region", []string{}, "Regions to deploy to, e.g. us-east-1,eu-west-1. Every --environment is deployed in each region. Default: the session's region")
+
+	cmd.Flags().StringToStringVar(&targetRoles, "target-role", map[string]string{}, "IAM role ARN to assume for a target, as <environment>=<role>, <region>=<role> or <environment>@<region>=<role>. Repeat for several targets. Default: --role")
+}
+
+// parseTargets returns a target for every environment of --environment in every --region. Targets in another region
+// or with their own role get a client of their own; the others share client.
+func parseTargets(client *deployer.Client) ([]*target, error) {
+	regionList := regions
+	if len(regionList) == 0 {
+		regionList = []string{""}
+	}
+
+	var targets []*target
+	for _, environment := range strings.Split(deploymentOptions.Environment, ",") {
+		for _, region := range regionList {
+			t := &target{Environment: strings.TrimSpace(environment), Region: strings.TrimSpace(region), Role: deploymentOptions.Role}
+			targets = append(targets, t)
+		}
+	}
+
+	for selector := range targetRoles {
+		matched := false
+		for _, t := range targets {
+			if t.matches(selector) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("--target-role %s matches no target", selector)
+		}
+	}
+
+	for _, t := range targets {
+		// The most specific selector wins
+		for _, selector := range []string{t.name(), t.Environment, t.Region} {
+			if role, ok := targetRoles[selector]; ok && selector != "" {
+				t.Role = role
+				break
+			}
+		}
+
+		if t.Region == "" && t.Role == deploymentOptions.Role {
+			t.client = client
+			continue
+		}
+		var err error
+		t.client, err = deployer.NewClient(deployer.WithRole(t.Role), deployer.WithRegion(t.Region), deployer.WithOutput(progress()))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return targets, nil
+}
+
+// buildWaves groups the targets into the waves given by --wave, each a comma separated list of target names,
+// environments or regions. Targets not named by any wave are deployed in a last wave.
+func buildWaves(targets []*target, specs []string) ([][]*target, error) {
+	var waves [][]*target
+	assigned := map[*target]bool{}
+	for _, spec := range specs {
+		var wave []*target
+		for _, selector := range strings.Split(spec, ",") {
+			selector = strings.TrimSpace(selector)
+			matched := false
+			for _, t := range targets {
+				if !t.matches(selector) {
+					continue
+				}
+				matched = true
+				if !assigned[t] {
+					assigned[t] = true
+					wave = append(wave, t)
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("--wave %s: no target matches %q", spec, selector)
+			}
+		}
+		if len(wave) > 0 {
+			waves = append(waves, wave)
+		}
+	}
+
+	var rest []*target
+	for _, t := range targets {
+		if !assigned[t] {
+			rest = append(rest, t)
+		}
+	}
+	if len(rest) > 0 {
+		waves = append(waves, rest)
+	}
+	return waves, nil
+}
+
+// rollbackCommands returns the rollback command for the updated services of each target
+func rollbackCommands(services []*serviceDeployment) []string {
+	var targets []*target
+	applications := map[*target][]string{}
+	for _, s := range services {
+		if _, ok := applications[s.target]; !ok {
+			targets = append(targets, s.target)
+		}
+		applications[s.target] = append(applications[s.target], s.options.Application)
+	}
+	sort.SliceStable(targets, func(i, j int) bool { return targets[i].name() < targets[j].name() })
+
+	var commands []string
+	for _, t := range targets {
+		command := fmt.Sprintf("ecs-deploy rollback -e %s -a %s", t.Environment, strings.Join(applications[t], ","))
+		if t.Region != "" {
+			command += " --region " + t.Region
+		}
+		if t.Role != "" {
+			command += " -r " + t.Role
+		}
+		commands = append(commands, command)
+	}
+	return commands
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/justmiles/ecs-deploy/src/deployer"
+	"github.com/spf13/cobra"
+)
+
+var forceUnlock bool
+
+func init() {
+	rootCmd.AddCommand(unlockCmd)
+
+	unlockCmd.Flags().StringVarP(&deploymentOptions.Application, "application", "a", "", "Application name to unlock")
+	unlockCmd.MarkFlagRequired("application")
+
+	unlockCmd.Flags().StringVarP(&deploymentOptions.Environment, "environment", "e", "", "Target environment")
+	unlockCmd.MarkFlagRequired("environment")
+
+	unlockCmd.Flags().StringVarP(&deploymentOptions.Role, "role", "r", "", "An IAM role ARN to assume before invoking a deployment.")
+
+	unlockCmd.Flags().BoolVar(&forceUnlock, "force", false, "Remove the lock even though another deployment may still hold it. Without --force the lock is only shown")
+}
+
+// addLockFlags adds the deployment lock flags to a command that deploys
+func addLockFlags(cmd *cobra.Command) {
+	cmd.Flags().DurationVar((*time.Duration)(&deploymentOptions.LockTimeout), "lock-timeout", 0, "How long to wait for another deployment of the service to release its lock before failing. 0 fails immediately")
+
+	cmd.Flags().DurationVar((*time.Duration)(&deploymentOptions.LockTTL), "lock-ttl", time.Hour, "After this long the lock is considered abandoned and the next deployment takes it over")
+
+	cmd.Flags().StringVar(&deploymentOptions.LockOwner, "lock-owner", deployer.DefaultLockOwner(), "Recorded in the lock to identify this deployment, e.g. a CI job URL")
+
+	cmd.Flags().BoolVar(&deploymentOptions.NoLock, "no-lock", false, "Deploy without taking the service's deployment lock")
+}
+
+var unlockCmd = &cobra.Command{
+	Use:   "unlock",
+	Short: "Show or remove the deployment lock of an application",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+		client := newClient()
+		report := newReport("unlock")
+
+		lock, err := client.GetLock(ctx, deploymentOptions)
+		if err != nil {
+			report.fail(OutcomeFailedToInvoke, ExitFailedToInvoke, err)
+		}
+		if lock == nil {
+			say("%s is not locked in %s\n", deploymentOptions.Application, deploymentOptions.Environment)
+			report.Outcome = OutcomeSucceeded
+			report.exit()
+		}
+
+		report.Lock = lock
+		if !forceUnlock {
+			report.fail(OutcomeFailedToInvoke, ExitFailedToInvoke, fmt.Errorf("%s is locked by %s; use --force to remove the lock", deploymentOptions.Application, lock))
+		}
+
+		lock, err = client.ForceUnlock(ctx, deploymentOptions)
+		if err != nil {
+			report.fail(OutcomeFailedToInvoke, ExitFailedToInvoke, err)
+		}
+		if lock != nil {
+			report.Lock = lock
+			say("Removed lock held by %s\n", lock)
+		}
+		report.Outcome = OutcomeSucceeded
+		report.exit()
+	},
+}
@@ -0,0 +1,117 @@
+package deployer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// AlarmState is the state of a CloudWatch alarm
+type AlarmState struct {
+	Name   string `json:"Name"`
+	State  string `json:"State"`
+	Reason string `json:"Reason,omitempty"`
+}
+
+// AlarmError is returned when a watched CloudWatch alarm goes to ALARM
+type AlarmError struct {
+	Alarms []AlarmState
+}
+
+func (e *AlarmError) Error() string {
+	var reasons []string
+	for _, alarm := range e.Alarms {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", alarm.Name, alarm.Reason))
+	}
+	return fmt.Sprintf("alarm triggered: %s", strings.Join(reasons, "; "))
+}
+
+// Bake watches the BakeAlarms for the Bake duration, returning an *AlarmError as soon as any of them is in ALARM
+func (c *Client) Bake(ctx context.Context, depOpts DeploymentOptions) error {
+	deadline := time.Now().Add(time.Duration(depOpts.Bake))
+
+	for {
+		err := c.checkAlarms(ctx, depOpts.BakeAlarms)
+		if err != nil {
+			return err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil
+		}
+		fmt.Fprintf(c.out, "  baking, %s remaining; alarms OK\n", remaining.Round(time.Second))
+
+		interval := c.waitInterval
+		if remaining < interval {
+			interval = remaining
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// checkAlarms returns an *AlarmError when any of the named alarms is in ALARM
+func (c *Client) checkAlarms(ctx context.Context, names []string) error {
+	alarms, err := c.describeAlarms(ctx, names)
+	if err != nil {
+		return err
+	}
+
+	alarmError := &AlarmError{}
+	for _, alarm := range alarms {
+		if alarm.State == cloudwatch.StateValueAlarm {
+			alarmError.Alarms = append(alarmError.Alarms, alarm)
+		}
+	}
+	if len(alarmError.Alarms) > 0 {
+		return alarmError
+	}
+	return nil
+}
+
+// describeAlarms returns the state of the named metric and composite alarms, failing when any of them does not exist
+func (c *Client) describeAlarms(ctx context.Context, names []string) ([]AlarmState, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	var alarms []AlarmState
+	err := c.cloudwatch.DescribeAlarmsPagesWithContext(ctx, &cloudwatch.DescribeAlarmsInput{
+		AlarmNames: aws.StringSlice(names),
+		AlarmTypes: aws.StringSlice([]string{cloudwatch.AlarmTypeMetricAlarm, cloudwatch.AlarmTypeCompositeAlarm}),
+	},
+		func(page *cloudwatch.DescribeAlarmsOutput, lastPage bool) bool {
+			for _, alarm := range page.MetricAlarms {
+				alarms = append(alarms, AlarmState{Name: aws.StringValue(alarm.AlarmName), State: aws.StringValue(alarm.StateValue), Reason: aws.StringValue(alarm.StateReason)})
+			}
+			for _, alarm := range page.CompositeAlarms {
+				alarms = append(alarms, AlarmState{Name: aws.StringValue(alarm.AlarmName), State: aws.StringValue(alarm.StateValue), Reason: aws.StringValue(alarm.StateReason)})
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		found := false
+		for _, alarm := range alarms {
+			if alarm.Name == name {
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("CloudWatch alarm %s not found", name)
+		}
+	}
+
+	return alarms, nil
+}
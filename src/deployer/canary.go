@@ -0,0 +1,246 @@
+package deployer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// CanaryTarget is the task set a canary release of a service using the EXTERNAL deployment controller creates and promotes
+type CanaryTarget struct {
+	// Scale is the percentage of the service's desired count the canary task set runs until it is promoted
+	Scale float64 `json:"Scale"`
+	// PrimaryTaskSet is the ARN of the task set serving the service before the release
+	PrimaryTaskSet string `json:"PrimaryTaskSet"`
+	// TaskSetCreate is the task set that will be created. TaskDefinition is set once the new revision is registered
+	TaskSetCreate *ecs.CreateTaskSetInput `json:"TaskSetCreate"`
+	// TaskSet is the ARN of the canary task set, once created
+	TaskSet string `json:"TaskSet,omitempty"`
+	// Promoted is set once the canary task set is the service's primary task set
+	Promoted bool `json:"Promoted"`
+}
+
+// isExternalService reports whether the service's task sets are managed by an external deployment controller
+func isExternalService(service *ecs.Service) bool {
+	return service.DeploymentController != nil && aws.StringValue(service.DeploymentController.Type) == ecs.DeploymentControllerTypeExternal
+}
+
+// newCanaryTarget plans a canary task set at depOpts.Canary percent, or 100 when unset, configured like the service's primary task set
+func newCanaryTarget(service *ecs.Service, depOpts DeploymentOptions) (*CanaryTarget, error) {
+	primary := primaryTaskSet(service)
+	if primary == nil {
+		return nil, fmt.Errorf("service %s uses an external deployment controller but has no primary task set", aws.StringValue(service.ServiceName))
+	}
+
+	scale := depOpts.Canary
+	if scale == 0 {
+		scale = 100
+	}
+	if scale < 0 || scale > 100 {
+		return nil, fmt.Errorf("invalid canary %v%%: must be between 0 and 100", scale)
+	}
+
+	return &CanaryTarget{
+		Scale:          scale,
+		PrimaryTaskSet: aws.StringValue(primary.TaskSetArn),
+		TaskSetCreate: &ecs.CreateTaskSetInput{
+			Cluster:                  service.ClusterArn,
+			Service:                  service.ServiceArn,
+			CapacityProviderStrategy: primary.CapacityProviderStrategy,
+			LaunchType:               primary.LaunchType,
+			LoadBalancers:            primary.LoadBalancers,
+			NetworkConfiguration:     primary.NetworkConfiguration,
+			PlatformVersion:          primary.PlatformVersion,
+			ServiceRegistries:        primary.ServiceRegistries,
+			Scale: &ecs.Scale{
+				Unit:  aws.String(ecs.ScaleUnitPercent),
+				Value: aws.Float64(scale),
+			},
+		},
+	}, nil
+}
+
+// createCanaryTaskSet creates the canary task set of taskDefinitionArn, recording its ARN in the target
+func (c *Client) createCanaryTaskSet(ctx context.Context, target *CanaryTarget, taskDefinitionArn *string) error {
+	target.TaskSetCreate.TaskDefinition = taskDefinitionArn
+	ctso, err := c.ecs.CreateTaskSetWithContext(ctx, target.TaskSetCreate)
+	if err != nil {
+		return err
+	}
+	target.TaskSet = aws.StringValue(ctso.TaskSet.TaskSetArn)
+	fmt.Fprintf(c.out, "Created task set %s at %v%%\n", aws.StringValue(ctso.TaskSet.Id), target.Scale)
+	return nil
+}
+
+// PromoteCanary makes the canary task set of an applied Plan the service's primary task set by
+//
+//	updating the service's primary task set
+//	scaling the canary task set to 100%
+//	waiting for it to reach a steady state
+//	deleting the previous primary task set
+//
+// A promotion that fails part way is undone by RollbackPlan.
+func (c *Client) PromoteCanary(ctx context.Context, plan *Plan) error {
+	canary := plan.Canary
+	if canary == nil || canary.TaskSet == "" {
+		return fmt.Errorf("plan has no canary task set to promote")
+	}
+
+	_, err := c.ecs.UpdateServicePrimaryTaskSetWithContext(ctx, &ecs.UpdateServicePrimaryTaskSetInput{
+		Cluster:        canary.TaskSetCreate.Cluster,
+		Service:        canary.TaskSetCreate.Service,
+		PrimaryTaskSet: aws.String(canary.TaskSet),
+	})
+	if err != nil {
+		return err
+	}
+	canary.Promoted = true
+	fmt.Fprintf(c.out, "Promoted task set %s to primary\n", canary.TaskSet)
+
+	if canary.Scale < 100 {
+		_, err = c.ecs.UpdateTaskSetWithContext(ctx, &ecs.UpdateTaskSetInput{
+			Cluster: canary.TaskSetCreate.Cluster,
+			Service: canary.TaskSetCreate.Service,
+			TaskSet: aws.String(canary.TaskSet),
+			Scale: &ecs.Scale{
+				Unit:  aws.String(ecs.ScaleUnitPercent),
+				Value: aws.Float64(100),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "Scaled task set %s to 100%%\n", canary.TaskSet)
+	}
+
+	err = c.WaitForTaskSet(ctx, plan.Options, canary.TaskSet)
+	if err != nil {
+		return err
+	}
+
+	err = c.deleteTaskSet(ctx, canary.TaskSetCreate.Cluster, canary.TaskSetCreate.Service, canary.PrimaryTaskSet)
+	if err != nil {
+		return fmt.Errorf("task set %s was promoted but deleting the previous task set failed: %v", canary.TaskSet, err)
+	}
+	return nil
+}
+
+// rollbackCanary returns the service to the task set that was primary before the release, deleting the canary task set
+func (c *Client) rollbackCanary(ctx context.Context, canary *CanaryTarget) error {
+	if canary.Promoted {
+		_, err := c.ecs.UpdateServicePrimaryTaskSetWithContext(ctx, &ecs.UpdateServicePrimaryTaskSetInput{
+			Cluster:        canary.TaskSetCreate.Cluster,
+			Service:        canary.TaskSetCreate.Service,
+			PrimaryTaskSet: aws.String(canary.PrimaryTaskSet),
+		})
+		if err != nil {
+			return err
+		}
+		canary.Promoted = false
+		fmt.Fprintf(c.out, "Restored task set %s to primary\n", canary.PrimaryTaskSet)
+	}
+
+	return c.deleteTaskSet(ctx, canary.TaskSetCreate.Cluster, canary.TaskSetCreate.Service, canary.TaskSet)
+}
+
+// deleteTaskSet deletes a task set, stopping its tasks
+func (c *Client) deleteTaskSet(ctx context.Context, cluster, service *string, taskSet string) error {
+	_, err := c.ecs.DeleteTaskSetWithContext(ctx, &ecs.DeleteTaskSetInput{
+		Cluster: cluster,
+		Service: service,
+		TaskSet: aws.String(taskSet),
+		Force:   aws.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Deleted task set %s\n", taskSet)
+	return nil
+}
+
+// WaitForTaskSet polls the ECS service until the task set reaches a steady state running its computed desired count,
+// or MaxAttempts is exhausted. Service events and the progress of every task set are streamed as they arrive.
+func (c *Client) WaitForTaskSet(ctx context.Context, depOpts DeploymentOptions, taskSetArn string) error {
+	maxAttempts := depOpts.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+
+	var seen map[string]bool
+	for attempt := 1; ; attempt++ {
+		service, err := c.describeService(ctx, depOpts)
+		if err != nil {
+			return err
+		}
+
+		// Only stream events raised after we started waiting
+		if seen == nil {
+			seen = map[string]bool{}
+			for _, event := range service.Events {
+				seen[aws.StringValue(event.Id)] = true
+			}
+		}
+		c.printServiceEvents(service, seen)
+		c.printTaskSets(service)
+
+		taskSet := findTaskSet(service, taskSetArn)
+		if taskSet == nil {
+			return fmt.Errorf("task set %s no longer exists", taskSetArn)
+		}
+		if aws.StringValue(taskSet.StabilityStatus) == ecs.StabilityStatusSteadyState && aws.Int64Value(taskSet.RunningCount) == aws.Int64Value(taskSet.ComputedDesiredCount) {
+			return nil
+		}
+
+		if attempt >= maxAttempts {
+			return fmt.Errorf("task set %s did not reach a steady state after %d attempts", aws.StringValue(taskSet.Id), maxAttempts)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.waitInterval):
+		}
+	}
+}
+
+// printTaskSets prints the progress of every task set of the service
+func (c *Client) printTaskSets(service *ecs.Service) {
+	for _, ts := range service.TaskSets {
+		taskDefinition := aws.StringValue(ts.TaskDefinition)
+		if family, revision, err := parseTaskDefinitionArn(taskDefinition); err == nil {
+			taskDefinition = fmt.Sprintf("%s:%d", family, revision)
+		}
+		var scale float64
+		if ts.Scale != nil {
+			scale = aws.Float64Value(ts.Scale.Value)
+		}
+
+		fmt.Fprintf(c.out, "  %-8s %s  %s at %v%%  running %d/%d, pending %d, %s\n",
+			aws.StringValue(ts.Status), aws.StringValue(ts.Id), taskDefinition, scale,
+			aws.Int64Value(ts.RunningCount), aws.Int64Value(ts.ComputedDesiredCount), aws.Int64Value(ts.PendingCount),
+			aws.StringValue(ts.StabilityStatus))
+	}
+}
+
+// primaryTaskSet returns the task set serving the service, if any
+func primaryTaskSet(service *ecs.Service) *ecs.TaskSet {
+	for _, ts := range service.TaskSets {
+		if aws.StringValue(ts.Status) == "PRIMARY" {
+			return ts
+		}
+	}
+	return nil
+}
+
+// findTaskSet returns the service task set with the given ARN, if any
+func findTaskSet(service *ecs.Service, arn string) *ecs.TaskSet {
+	for _, ts := range service.TaskSets {
+		if aws.StringValue(ts.TaskSetArn) == arn {
+			return ts
+		}
+	}
+	return nil
+}
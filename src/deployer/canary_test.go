@@ -0,0 +1,122 @@
+package deployer
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestCanaryPlanAndApply(t *testing.T) {
+	fakeECS := newFakeExternalECS()
+	fakeSSM := &fakeSSM{parameters: map[string]string{"/prd/app/VERSION": "1.1"}}
+	client := newFakeClient(t, fakeECS, fakeSSM)
+
+	plan, err := client.PlanDeployment(context.Background(), DeploymentOptions{Application: "app", Environment: "prd", Version: "1.2", Canary: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The base task definition is the one the primary task set runs
+	if got := aws.StringValue(plan.BaseTaskDefinition.TaskDefinitionArn); got != testTaskDefinitionArn {
+		t.Errorf("BaseTaskDefinition = %s, want %s", got, testTaskDefinitionArn)
+	}
+	if plan.Canary == nil || plan.Canary.PrimaryTaskSet != testPrimaryTaskSetArn || plan.Canary.Scale != 10 {
+		t.Fatalf("Canary = %+v, want a 10%% task set next to %s", plan.Canary, testPrimaryTaskSetArn)
+	}
+	wantContainers := []ContainerChanges{{
+		Name:    "web",
+		Changes: []FieldChange{{Field: "Image", Old: "registry.local:5000/team/app:1.1", New: "registry.local:5000/team/app:1.2"}},
+	}}
+	if !reflect.DeepEqual(plan.Containers, wantContainers) {
+		t.Errorf("Containers = %+v, want %+v", plan.Containers, wantContainers)
+	}
+
+	err = client.CheckPlan(context.Background(), plan)
+	if err != nil {
+		t.Fatalf("CheckPlan() of a fresh plan: %v", err)
+	}
+
+	results, err := client.ApplyPlan(context.Background(), plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fakeECS.updated != nil {
+		t.Error("the service was updated instead of creating a task set")
+	}
+	created := fakeECS.createdTaskSet
+	if created == nil || aws.StringValue(created.TaskDefinition) != testNewTaskDefinitionArn || aws.Float64Value(created.Scale.Value) != 10 || aws.StringValue(created.LaunchType) != "FARGATE" {
+		t.Fatalf("created task set = %+v, want the new task definition at 10%% configured like the primary task set", created)
+	}
+	if results.TaskSet != testCanaryTaskSetArn || results.TaskDefinition != testNewTaskDefinitionArn {
+		t.Errorf("results = %+v, want task set %s running %s", results, testCanaryTaskSetArn, testNewTaskDefinitionArn)
+	}
+	if got := fakeSSM.parameters["/prd/app/VERSION"]; got != "1.2" {
+		t.Errorf("version parameter = %s, want 1.2", got)
+	}
+
+	err = client.PromoteCanary(context.Background(), plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := primaryTaskSet(fakeECS.service)
+	if primary == nil || aws.StringValue(primary.TaskSetArn) != testCanaryTaskSetArn || aws.Float64Value(primary.Scale.Value) != 100 {
+		t.Errorf("primary task set = %+v, want the canary at 100%%", primary)
+	}
+	if !reflect.DeepEqual(fakeECS.deletedTaskSets, []string{testPrimaryTaskSetArn}) {
+		t.Errorf("deleted task sets = %v, want the previous primary %s", fakeECS.deletedTaskSets, testPrimaryTaskSetArn)
+	}
+}
+
+func TestCheckPlanStaleCanary(t *testing.T) {
+	fakeECS := newFakeExternalECS()
+	client := newFakeClient(t, fakeECS, &fakeSSM{parameters: map[string]string{}})
+
+	plan, err := client.PlanDeployment(context.Background(), DeploymentOptions{Application: "app", Environment: "prd", Version: "1.2", Canary: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another release replaced the primary task set's task definition since the plan was made
+	fakeECS.service.TaskSets[0].TaskDefinition = aws.String(testNewTaskDefinitionArn)
+
+	err = client.CheckPlan(context.Background(), plan)
+	var stale *StalePlanError
+	if !errors.As(err, &stale) || stale.Current != testNewTaskDefinitionArn {
+		t.Fatalf("CheckPlan() error = %v, want a *StalePlanError naming %s", err, testNewTaskDefinitionArn)
+	}
+}
+
+func TestRollbackCanary(t *testing.T) {
+	fakeECS := newFakeExternalECS()
+	fakeSSM := &fakeSSM{parameters: map[string]string{"/prd/app/VERSION": "1.1"}}
+	client := newFakeClient(t, fakeECS, fakeSSM)
+
+	plan, err := client.PlanDeployment(context.Background(), DeploymentOptions{Application: "app", Environment: "prd", Version: "1.2", Canary: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.ApplyPlan(context.Background(), plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := client.RollbackPlan(context.Background(), plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.TaskSet != testPrimaryTaskSetArn {
+		t.Errorf("results task set = %s, want the previous primary %s", results.TaskSet, testPrimaryTaskSetArn)
+	}
+	if !reflect.DeepEqual(fakeECS.deletedTaskSets, []string{testCanaryTaskSetArn}) {
+		t.Errorf("deleted task sets = %v, want the canary %s", fakeECS.deletedTaskSets, testCanaryTaskSetArn)
+	}
+	if primary := primaryTaskSet(fakeECS.service); primary == nil || aws.StringValue(primary.TaskSetArn) != testPrimaryTaskSetArn {
+		t.Errorf("primary task set = %+v, want %s", primary, testPrimaryTaskSetArn)
+	}
+	if got := fakeSSM.parameters["/prd/app/VERSION"]; got != "1.1" {
+		t.Errorf("version parameter = %s, want it restored to 1.1", got)
+	}
+}
@@ -0,0 +1,195 @@
+package deployer
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/codedeploy"
+	"github.com/aws/aws-sdk-go/service/codedeploy/codedeployiface"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// Client performs deployments against ECS using the AWS clients it was built with
+type Client struct {
+	sess         *session.Session
+	role         string
+	region       string
+	out          io.Writer
+	waitInterval time.Duration
+	ecs          ecsiface.ECSAPI
+	ssm          ssmiface.SSMAPI
+	cloudwatch   cloudwatchiface.CloudWatchAPI
+	codedeploy   codedeployiface.CodeDeployAPI
+	elbv2        elbv2iface.ELBV2API
+	ecrFor       func(region string) ecriface.ECRAPI
+	http         *http.Client
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithSession sets the AWS session used to build any client not provided explicitly
+func WithSession(sess *session.Session) Option {
+	return func(c *Client) {
+		c.sess = sess
+	}
+}
+
+// WithRole sets an IAM role ARN to assume when building AWS clients from the session
+func WithRole(role string) Option {
+	return func(c *Client) {
+		c.role = role
+	}
+}
+
+// WithRegion sets the region of AWS clients built from the session. Default: the session's region
+func WithRegion(region string) Option {
+	return func(c *Client) {
+		c.region = region
+	}
+}
+
+// WithECS sets the ECS client
+func WithECS(api ecsiface.ECSAPI) Option {
+	return func(c *Client) {
+		c.ecs = api
+	}
+}
+
+// WithSSM sets the SSM client
+func WithSSM(api ssmiface.SSMAPI) Option {
+	return func(c *Client) {
+		c.ssm = api
+	}
+}
+
+// WithCloudWatch sets the CloudWatch client used to watch alarms
+func WithCloudWatch(api cloudwatchiface.CloudWatchAPI) Option {
+	return func(c *Client) {
+		c.cloudwatch = api
+	}
+}
+
+// WithCodeDeploy sets the CodeDeploy client used to deploy services with the CODE_DEPLOY deployment controller
+func WithCodeDeploy(api codedeployiface.CodeDeployAPI) Option {
+	return func(c *Client) {
+		c.codedeploy = api
+	}
+}
+
+// WithELBV2 sets the Elastic Load Balancing client used to shift traffic and check target health
+func WithELBV2(api elbv2iface.ELBV2API) Option {
+	return func(c *Client) {
+		c.elbv2 = api
+	}
+}
+
+// WithECR sets the ECR client used to verify images in every region
+func WithECR(api ecriface.ECRAPI) Option {
+	return func(c *Client) {
+		c.ecrFor = func(string) ecriface.ECRAPI { return api }
+	}
+}
+
+// WithHTTPClient sets the HTTP client used to run smoke tests. Default: http.DefaultClient
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.http = client
+	}
+}
+
+// WithOutput sets where progress and diffs are written. Default: os.Stdout
+func WithOutput(w io.Writer) Option {
+	return func(c *Client) {
+		c.out = w
+	}
+}
+
+// WithWaitInterval sets the pause between polls while waiting for a deployment. Default: 15s
+func WithWaitInterval(interval time.Duration) Option {
+	return func(c *Client) {
+		c.waitInterval = interval
+	}
+}
+
+// Clone returns a copy of the client with opts applied. AWS clients are shared unless replaced by opts, so a copy
+// can e.g. write its progress elsewhere while deploying another service concurrently.
+func (c *Client) Clone(opts ...Option) *Client {
+	clone := *c
+	for _, opt := range opts {
+		opt(&clone)
+	}
+	return &clone
+}
+
+// NewClient builds a Client. AWS clients not provided through options are created from the
+// session (shared config by default), assuming the configured role when one is set.
+func NewClient(opts ...Option) (*Client, error) {
+	c := &Client{
+		out:          os.Stdout,
+		waitInterval: defaultWaitInterval,
+		http:         http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.ecs != nil && c.ssm != nil && c.cloudwatch != nil && c.codedeploy != nil && c.elbv2 != nil && c.ecrFor != nil {
+		return c, nil
+	}
+
+	if c.sess == nil {
+		sess, err := session.NewSessionWithOptions(session.Options{
+			SharedConfigState: session.SharedConfigEnable,
+		})
+		if err != nil {
+			return nil, err
+		}
+		c.sess = sess
+	}
+
+	cfg := aws.NewConfig()
+	if c.role != "" {
+		cfg = cfg.WithCredentials(stscreds.NewCredentials(c.sess, c.role))
+	}
+	if c.region != "" {
+		cfg = cfg.WithRegion(c.region)
+	}
+
+	if c.ecs == nil {
+		c.ecs = ecs.New(c.sess, cfg)
+	}
+	if c.ssm == nil {
+		c.ssm = ssm.New(c.sess, cfg)
+	}
+	if c.cloudwatch == nil {
+		c.cloudwatch = cloudwatch.New(c.sess, cfg)
+	}
+	if c.codedeploy == nil {
+		c.codedeploy = codedeploy.New(c.sess, cfg)
+	}
+	if c.elbv2 == nil {
+		c.elbv2 = elbv2.New(c.sess, cfg)
+	}
+	if c.ecrFor == nil {
+		c.ecrFor = func(region string) ecriface.ECRAPI {
+			return ecr.New(c.sess, cfg.Copy().WithRegion(region))
+		}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,286 @@
+package deployer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codedeploy"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// CodeDeployTarget is the CodeDeploy application and deployment group that deploys a service using the CODE_DEPLOY deployment controller
+type CodeDeployTarget struct {
+	Application     string `json:"Application"`
+	DeploymentGroup string `json:"DeploymentGroup"`
+	// ContainerName and ContainerPort receive traffic from the load balancer
+	ContainerName string `json:"ContainerName"`
+	ContainerPort int64  `json:"ContainerPort"`
+	// DeploymentID of the CodeDeploy deployment, once created
+	DeploymentID string `json:"DeploymentID,omitempty"`
+}
+
+// appSpec is the AppSpec of an ECS CodeDeploy deployment
+type appSpec struct {
+	Version   string                       `json:"version"`
+	Resources []map[string]appSpecResource `json:"Resources"`
+}
+
+type appSpecResource struct {
+	Type       string            `json:"Type"`
+	Properties appSpecProperties `json:"Properties"`
+}
+
+type appSpecProperties struct {
+	TaskDefinition   string                  `json:"TaskDefinition"`
+	LoadBalancerInfo appSpecLoadBalancerInfo `json:"LoadBalancerInfo"`
+}
+
+type appSpecLoadBalancerInfo struct {
+	ContainerName string `json:"ContainerName"`
+	ContainerPort int64  `json:"ContainerPort"`
+}
+
+// isCodeDeployService reports whether the service is deployed by CodeDeploy
+func isCodeDeployService(service *ecs.Service) bool {
+	return service.DeploymentController != nil && aws.StringValue(service.DeploymentController.Type) == ecs.DeploymentControllerTypeCodeDeploy
+}
+
+// newCodeDeployTarget resolves the CodeDeploy application and deployment group of a service. Unless set in
+// depOpts, they default to the names the ECS console creates: AppECS-<cluster>-<service> and DgpECS-<cluster>-<service>.
+func newCodeDeployTarget(service *ecs.Service, depOpts DeploymentOptions) (*CodeDeployTarget, error) {
+	if len(service.LoadBalancers) == 0 {
+		return nil, fmt.Errorf("service %s uses CodeDeploy but has no load balancer", aws.StringValue(service.ServiceName))
+	}
+
+	cluster := aws.StringValue(service.ClusterArn)
+	cluster = cluster[strings.LastIndex(cluster, "/")+1:]
+
+	target := &CodeDeployTarget{
+		Application:     depOpts.CodeDeployApplication,
+		DeploymentGroup: depOpts.CodeDeployDeploymentGroup,
+		ContainerName:   aws.StringValue(service.LoadBalancers[0].ContainerName),
+		ContainerPort:   aws.Int64Value(service.LoadBalancers[0].ContainerPort),
+	}
+	if target.Application == "" {
+		target.Application = fmt.Sprintf("AppECS-%s-%s", cluster, aws.StringValue(service.ServiceName))
+	}
+	if target.DeploymentGroup == "" {
+		target.DeploymentGroup = fmt.Sprintf("DgpECS-%s-%s", cluster, aws.StringValue(service.ServiceName))
+	}
+	return target, nil
+}
+
+// createCodeDeployDeployment starts a blue/green deployment of taskDefinitionArn with a generated AppSpec
+func (c *Client) createCodeDeployDeployment(ctx context.Context, target *CodeDeployTarget, taskDefinitionArn, description string) (string, error) {
+	spec, err := json.Marshal(appSpec{
+		Version: "0.0",
+		Resources: []map[string]appSpecResource{{
+			"TargetService": {
+				Type: "AWS::ECS::Service",
+				Properties: appSpecProperties{
+					TaskDefinition: taskDefinitionArn,
+					LoadBalancerInfo: appSpecLoadBalancerInfo{
+						ContainerName: target.ContainerName,
+						ContainerPort: target.ContainerPort,
+					},
+				},
+			},
+		}},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	cdo, err := c.codedeploy.CreateDeploymentWithContext(ctx, &codedeploy.CreateDeploymentInput{
+		ApplicationName:     aws.String(target.Application),
+		DeploymentGroupName: aws.String(target.DeploymentGroup),
+		Description:         aws.String(description),
+		Revision: &codedeploy.RevisionLocation{
+			RevisionType: aws.String(codedeploy.RevisionLocationTypeAppSpecContent),
+			AppSpecContent: &codedeploy.AppSpecContent{
+				Content: aws.String(string(spec)),
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to create CodeDeploy deployment in %s/%s: %v", target.Application, target.DeploymentGroup, err)
+	}
+	return aws.StringValue(cdo.DeploymentId), nil
+}
+
+// rollbackCodeDeployDeployment returns a CODE_DEPLOY service to taskDefinitionArn. A deployment that is still in progress is
+// stopped with automatic rollback; one that already succeeded, e.g. before a bake alarm triggered, is replaced by a new deployment.
+// It returns the id of the rollback deployment.
+func (c *Client) rollbackCodeDeployDeployment(ctx context.Context, depOpts DeploymentOptions, target *CodeDeployTarget, taskDefinitionArn string) (string, error) {
+	gdo, err := c.codedeploy.GetDeploymentWithContext(ctx, &codedeploy.GetDeploymentInput{
+		DeploymentId: aws.String(target.DeploymentID),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	switch aws.StringValue(gdo.DeploymentInfo.Status) {
+	case codedeploy.DeploymentStatusSucceeded, codedeploy.DeploymentStatusFailed, codedeploy.DeploymentStatusStopped:
+		description := fmt.Sprintf("ecs-deploy: roll back %s to %s", depOpts.Application, taskDefinitionArn)
+		return c.createCodeDeployDeployment(ctx, target, taskDefinitionArn, description)
+	}
+	return c.stopCodeDeployDeployment(ctx, depOpts, target.DeploymentID)
+}
+
+// stopCodeDeployDeployment stops a CodeDeploy deployment with automatic rollback, returning the id of the rollback deployment
+func (c *Client) stopCodeDeployDeployment(ctx context.Context, depOpts DeploymentOptions, deploymentID string) (string, error) {
+	_, err := c.codedeploy.StopDeploymentWithContext(ctx, &codedeploy.StopDeploymentInput{
+		DeploymentId:        aws.String(deploymentID),
+		AutoRollbackEnabled: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	maxAttempts := depOpts.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+
+	// CodeDeploy creates the rollback deployment asynchronously
+	for attempt := 1; ; attempt++ {
+		gdo, err := c.codedeploy.GetDeploymentWithContext(ctx, &codedeploy.GetDeploymentInput{
+			DeploymentId: aws.String(deploymentID),
+		})
+		if err != nil {
+			return "", err
+		}
+		if info := gdo.DeploymentInfo.RollbackInfo; info != nil && aws.StringValue(info.RollbackDeploymentId) != "" {
+			return aws.StringValue(info.RollbackDeploymentId), nil
+		}
+
+		if attempt >= maxAttempts {
+			return "", fmt.Errorf("CodeDeploy did not create a rollback deployment for %s", deploymentID)
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(c.waitInterval):
+		}
+	}
+}
+
+// WaitForCodeDeployDeployment polls a CodeDeploy deployment until it succeeds, fails or MaxAttempts is exhausted,
+// streaming its status and the lifecycle events of its ECS targets as they change.
+func (c *Client) WaitForCodeDeployDeployment(ctx context.Context, depOpts DeploymentOptions, deploymentID string) error {
+	maxAttempts := depOpts.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+
+	var status string
+	lifecycle := map[string]string{}
+	for attempt := 1; ; attempt++ {
+		gdo, err := c.codedeploy.GetDeploymentWithContext(ctx, &codedeploy.GetDeploymentInput{
+			DeploymentId: aws.String(deploymentID),
+		})
+		if err != nil {
+			return err
+		}
+		info := gdo.DeploymentInfo
+
+		if aws.StringValue(info.Status) != status {
+			status = aws.StringValue(info.Status)
+			fmt.Fprintf(c.out, "%s  CodeDeploy deployment %s %s\n", time.Now().Format(time.Kitchen), deploymentID, status)
+		}
+		c.printCodeDeployLifecycle(ctx, deploymentID, lifecycle)
+
+		switch status {
+		case codedeploy.DeploymentStatusSucceeded:
+			return nil
+		case codedeploy.DeploymentStatusFailed, codedeploy.DeploymentStatusStopped:
+			rolloutFailedError := &RolloutFailedError{
+				TaskDefinition: appSpecTaskDefinition(info),
+				DeploymentID:   deploymentID,
+				Reason:         status,
+				Controller:     "CodeDeploy",
+			}
+			if info.ErrorInformation != nil {
+				rolloutFailedError.Reason = aws.StringValue(info.ErrorInformation.Message)
+			}
+			// The service only runs the previous task definition again once the rollback deployment completes
+			if info.RollbackInfo != nil && aws.StringValue(info.RollbackInfo.RollbackDeploymentId) != "" {
+				rollbackID := aws.StringValue(info.RollbackInfo.RollbackDeploymentId)
+				fmt.Fprintf(c.out, "Waiting for CodeDeploy rollback deployment %s to complete\n", rollbackID)
+				err = c.WaitForCodeDeployDeployment(ctx, depOpts, rollbackID)
+				if err != nil {
+					rolloutFailedError.Reason = fmt.Sprintf("%s; rollback deployment %s did not complete: %v", rolloutFailedError.Reason, rollbackID, err)
+				} else {
+					rolloutFailedError.RolledBack = true
+				}
+			}
+			return rolloutFailedError
+		}
+
+		if attempt >= maxAttempts {
+			return fmt.Errorf("CodeDeploy deployment %s did not complete after %d attempts", deploymentID, maxAttempts)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.waitInterval):
+		}
+	}
+}
+
+// appSpecTaskDefinition returns the task definition a CodeDeploy deployment deploys, read from its AppSpec, or "" when
+// the AppSpec is not one created by createCodeDeployDeployment
+func appSpecTaskDefinition(info *codedeploy.DeploymentInfo) string {
+	if info.Revision == nil || info.Revision.AppSpecContent == nil {
+		return ""
+	}
+	spec := appSpec{}
+	err := json.Unmarshal([]byte(aws.StringValue(info.Revision.AppSpecContent.Content)), &spec)
+	if err != nil {
+		return ""
+	}
+	for _, resource := range spec.Resources {
+		for _, r := range resource {
+			return r.Properties.TaskDefinition
+		}
+	}
+	return ""
+}
+
+// printCodeDeployLifecycle prints the lifecycle events of the deployment's ECS targets whose status changed
+func (c *Client) printCodeDeployLifecycle(ctx context.Context, deploymentID string, lifecycle map[string]string) {
+	ldto, err := c.codedeploy.ListDeploymentTargetsWithContext(ctx, &codedeploy.ListDeploymentTargetsInput{
+		DeploymentId: aws.String(deploymentID),
+	})
+	if err != nil || len(ldto.TargetIds) == 0 {
+		return
+	}
+
+	bgdto, err := c.codedeploy.BatchGetDeploymentTargetsWithContext(ctx, &codedeploy.BatchGetDeploymentTargetsInput{
+		DeploymentId: aws.String(deploymentID),
+		TargetIds:    ldto.TargetIds,
+	})
+	if err != nil {
+		return
+	}
+
+	for _, target := range bgdto.DeploymentTargets {
+		if target.EcsTarget == nil {
+			continue
+		}
+		for _, event := range target.EcsTarget.LifecycleEvents {
+			name := aws.StringValue(event.LifecycleEventName)
+			if lifecycle[name] == aws.StringValue(event.Status) {
+				continue
+			}
+			lifecycle[name] = aws.StringValue(event.Status)
+			fmt.Fprintf(c.out, "  %-24s %s\n", name, lifecycle[name])
+		}
+	}
+}
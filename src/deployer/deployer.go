@@ -1,343 +1,228 @@
 package deployer
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"log"
-	"os"
+	"sort"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
-	"github.com/aws/aws-sdk-go/aws/request"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/aws/aws-sdk-go/service/ssm"
 
 	"github.com/mitchellh/copystructure"
 )
 
-var (
-	sess = session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	}))
-)
-
 // PerformDeployment initiates an ECS deployment by
 //
-//	setting desired version in SSM Parameter Store /<env>/<app>/VERSION
 //	bumping the image version in task definition
 //	registering new task definition with the ECS service
-func PerformDeployment(depOpts DeploymentOptions) (s string, err error) {
-	var deploymentResults DeploymentResults
-	// Set the desired application version
-	if !depOpts.DryRun {
-		err = setDesiredVersion(depOpts)
-		if err != nil {
-			return s, err
+//	setting desired version in SSM Parameter Store /<env>/<app>/VERSION
+//
+// With DryRun set, nothing is modified and the results only carry the Plan. Unless NoLock is set, the service is locked
+// for the duration of the deployment so a concurrent deployment cannot plan against the same base task definition.
+// Failing to release the lock is returned along with the results of the deployment.
+func (c *Client) PerformDeployment(ctx context.Context, depOpts DeploymentOptions) (results *DeploymentResults, err error) {
+	// The deployment is not waited on, so nothing would write the version parameter once the service is stable
+	if depOpts.SetVersionAfterStable && !depOpts.DryRun {
+		return nil, fmt.Errorf("SetVersionAfterStable requires waiting for the deployment; use PlanDeployment, ApplyPlan, WaitForDeployment and PublishVersion")
+	}
+
+	if !depOpts.DryRun && !depOpts.NoLock {
+		lock, lerr := c.AcquireLock(ctx, depOpts)
+		if lerr != nil {
+			return nil, lerr
 		}
+		// Release even when ctx was cancelled. A lock left behind blocks the next deployment until its TTL expires.
+		defer func() {
+			rerr := c.ReleaseLock(context.Background(), lock)
+			if rerr == nil {
+				return
+			}
+			if err != nil {
+				err = fmt.Errorf("%w; releasing lock %s failed: %v", err, lock.Parameter, rerr)
+			} else {
+				err = fmt.Errorf("releasing lock %s failed: %w", lock.Parameter, rerr)
+			}
+		}()
 	}
 
-	var svc *ecs.ECS
+	plan, err := c.PlanDeployment(ctx, depOpts)
+	if err != nil {
+		return nil, err
+	}
 
-	if depOpts.Role != "" {
-		creds := stscreds.NewCredentials(sess, depOpts.Role)
-		svc = ecs.New(sess, &aws.Config{Credentials: creds})
-	} else {
-		svc = ecs.New(sess)
+	if depOpts.DryRun {
+		return &DeploymentResults{Plan: plan}, nil
 	}
 
+	return c.ApplyPlan(ctx, plan)
+}
+
+// PerformReDeployment initiates an ECS re-deployment
+func (c *Client) PerformReDeployment(ctx context.Context, depOpts DeploymentOptions) (*DeploymentResults, error) {
+	deploymentResults := &DeploymentResults{}
+
 	// Get the ECS Service
-	dsi := &ecs.DescribeServicesInput{
+	service, err := c.describeService(ctx, depOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	uso, err := c.ecs.UpdateServiceWithContext(ctx, &ecs.UpdateServiceInput{
+		ForceNewDeployment: aws.Bool(true),
+		Cluster:            service.ClusterArn,
+		Service:            service.ServiceArn,
+	})
+	if err != nil {
+		return nil, err
+	}
+	deploymentResults.SetService(uso.Service)
+
+	return deploymentResults, nil
+}
+
+// describeService returns the ECS service named by depOpts
+func (c *Client) describeService(ctx context.Context, depOpts DeploymentOptions) (*ecs.Service, error) {
+	dso, err := c.ecs.DescribeServicesWithContext(ctx, &ecs.DescribeServicesInput{
 		Cluster: aws.String(depOpts.Environment),
 		Services: []*string{
 			aws.String(depOpts.Application),
 		},
-	}
-	dso, err := svc.DescribeServices(dsi)
+	})
 	if err != nil {
-		return s, err
+		return nil, err
 	}
 
-	if len(dso.Failures) > 0 {
-		log.Println(dso.Failures)
-		return s, fmt.Errorf("unable to find service %s in cluster %s", depOpts.Application, depOpts.Environment)
+	if len(dso.Failures) > 0 || len(dso.Services) == 0 {
+		return nil, fmt.Errorf("unable to find service %s in cluster %s: %v", depOpts.Application, depOpts.Environment, dso.Failures)
 	}
 
-	// Get the ECS service's full task definition
-	dtdi := &ecs.DescribeTaskDefinitionInput{
-		TaskDefinition: dso.Services[0].TaskDefinition,
+	return dso.Services[0], nil
+}
+
+// runningTaskDefinition returns the ARN of the task definition the service runs. Services using the EXTERNAL deployment
+// controller run it on their primary task set rather than on the service.
+func runningTaskDefinition(service *ecs.Service) (string, error) {
+	taskDefinition := aws.StringValue(service.TaskDefinition)
+	if isExternalService(service) {
+		primary := primaryTaskSet(service)
+		if primary == nil {
+			return "", fmt.Errorf("service %s uses an external deployment controller but has no primary task set", aws.StringValue(service.ServiceName))
+		}
+		taskDefinition = aws.StringValue(primary.TaskDefinition)
 	}
-	dtdo, err := svc.DescribeTaskDefinition(dtdi)
-	if err != nil {
-		return s, err
+	if taskDefinition == "" {
+		return "", fmt.Errorf("service %s has no task definition", aws.StringValue(service.ServiceName))
 	}
+	return taskDefinition, nil
+}
 
-	// Deep copy to preserve original container definitions for diff
-	copyContainerDefs, err := copystructure.Copy(dtdo.TaskDefinition.ContainerDefinitions)
+// copyContainerDefinitions returns a deep copy of container definitions
+func copyContainerDefinitions(containerDefinitions []*ecs.ContainerDefinition) ([]*ecs.ContainerDefinition, error) {
+	copyContainerDefs, err := copystructure.Copy(containerDefinitions)
 	if err != nil {
-		fmt.Printf("Error performing deep copy of container definitions: %v", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("error performing deep copy of container definitions: %v", err)
 	}
 	desiredContainerDefinitions, ok := copyContainerDefs.([]*ecs.ContainerDefinition)
 	if !ok {
-		fmt.Printf("Error converting interface to ecs.ContainerDefinition: %v", err)
-		os.Exit(1)
-	}
-
-	// Update only first container definition
-	repoAndVersion := strings.Split(*desiredContainerDefinitions[0].Image, ":")
-	if len(repoAndVersion) == 1 {
-		repoAndVersion = append(repoAndVersion, depOpts.Version)
-	} else {
-		repoAndVersion[1] = depOpts.Version
-	}
-
-	// Update only the first contianer image version - ignore sidecar containers assuming they are defined second, third, and so on.
-	*desiredContainerDefinitions[0].Image = strings.Join(repoAndVersion, ":")
-
-	// Register new task definition
-	rtdi := &ecs.RegisterTaskDefinitionInput{
-		ContainerDefinitions:    desiredContainerDefinitions,
-		Cpu:                     dtdo.TaskDefinition.Cpu,
-		ExecutionRoleArn:        dtdo.TaskDefinition.ExecutionRoleArn,
-		Family:                  dtdo.TaskDefinition.Family,
-		Memory:                  dtdo.TaskDefinition.Memory,
-		NetworkMode:             dtdo.TaskDefinition.NetworkMode,
-		PlacementConstraints:    dtdo.TaskDefinition.PlacementConstraints,
-		TaskRoleArn:             dtdo.TaskDefinition.TaskRoleArn,
-		Volumes:                 dtdo.TaskDefinition.Volumes,
-		RequiresCompatibilities: dtdo.TaskDefinition.RequiresCompatibilities,
+		return nil, fmt.Errorf("error converting interface to ecs.ContainerDefinition")
 	}
+	return desiredContainerDefinitions, nil
+}
 
-	if depOpts.RefreshSecrets {
-
-		for _, dcd := range desiredContainerDefinitions {
-			// Clear all existing secrets
-			dcd.Secrets = []*ecs.Secret{}
-		}
-
-		for _, secretsPrefix := range depOpts.SecretsPrefix {
-
-			globalSecrets, err := getEcsSecretsBySSMPath(depOpts, secretsPrefix)
-			if err != nil {
-				fmt.Printf("Error refreshing ssm params: %v", err)
-				os.Exit(1)
+// setContainerImageVersions bumps the image version of the containers targeted by depOpts.
+//
+//	Images - each named container is set to its own version
+//	Container - the named container is set to Version
+//	otherwise the first container is set to Version, assuming sidecar containers are defined second, third, and so on.
+func setContainerImageVersions(depOpts DeploymentOptions, containerDefinitions []*ecs.ContainerDefinition) error {
+	if len(containerDefinitions) == 0 {
+		return fmt.Errorf("task definition has no container definitions")
+	}
+
+	if len(depOpts.Images) > 0 {
+		for name, version := range depOpts.Images {
+			cd := findContainerDefinition(containerDefinitions, name)
+			if cd == nil {
+				return fmt.Errorf("container %s not found in task definition", name)
 			}
-
-			for _, dcd := range desiredContainerDefinitions {
-				// Deep copy ecs.secrets, so items in each list are separate and distict memory addresses
-				copyGlobalSecrets, err := copystructure.Copy(globalSecrets)
-				if err != nil {
-					fmt.Printf("Error performing deep copy of container definitions: %v", err)
-					os.Exit(1)
-				}
-				newGlobalSecrets, ok := copyGlobalSecrets.([]*ecs.Secret)
-				if !ok {
-					fmt.Printf("Error converting interface to ecs.ContainerDefinition: %v", err)
-					os.Exit(1)
-				}
-
-				// Get container specific secrets
-				containerSpecificSecrets, err := getEcsSecretsBySSMPath(depOpts, fmt.Sprintf("%s/%s", secretsPrefix, *dcd.Name))
-
-				if err != nil {
-					fmt.Printf("Error getting continaer secret by ssm path: %v", err)
-					os.Exit(1)
-				}
-
-				// Add Secrets to container
-				dcd.Secrets = append(dcd.Secrets, newGlobalSecrets...)
-				dcd.Secrets = append(dcd.Secrets, containerSpecificSecrets...)
+			err := setImageVersion(cd, version)
+			if err != nil {
+				return err
 			}
 		}
+		return nil
 	}
 
-	// Diff task image version
-	for index, currentContainerDef := range dtdo.TaskDefinition.ContainerDefinitions {
-		diff := NewDiff("container", *currentContainerDef.Name)
-		diff.AddChange("image", *currentContainerDef.Image, *desiredContainerDefinitions[index].Image)
+	cd := containerDefinitions[0]
+	if depOpts.Container != "" {
+		cd = findContainerDefinition(containerDefinitions, depOpts.Container)
+		if cd == nil {
+			return fmt.Errorf("container %s not found in task definition", depOpts.Container)
+		}
+	}
+	return setImageVersion(cd, depOpts.Version)
+}
 
-		// Diff task secrets
-		if depOpts.RefreshSecrets {
-			for _, x := range currentContainerDef.Secrets {
-				found := false
-				for _, y := range desiredContainerDefinitions[index].Secrets {
-					// TODO diff secrets
-					if *x.Name == *y.Name {
-						diff.AddChange(*x.Name, *x.ValueFrom, *y.ValueFrom)
-						found = true
-					}
-				}
+// setContainerEnvironment sets the ContainerEnvironment variables of each named container, keeping its other variables
+func setContainerEnvironment(depOpts DeploymentOptions, containerDefinitions []*ecs.ContainerDefinition) error {
+	for name, variables := range depOpts.ContainerEnvironment {
+		cd := findContainerDefinition(containerDefinitions, name)
+		if cd == nil {
+			return fmt.Errorf("container %s not found in task definition", name)
+		}
 
-				if !found {
-					diff.AddChange(*x.Name, *x.ValueFrom, "")
+		// New variables are appended in a stable order
+		keys := make([]string, 0, len(variables))
+		for key := range variables {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			found := false
+			for _, kvp := range cd.Environment {
+				if aws.StringValue(kvp.Name) == key {
+					kvp.Value = aws.String(variables[key])
+					found = true
 				}
 			}
-
-			for _, y := range desiredContainerDefinitions[index].Secrets {
-				found := false
-				for _, x := range currentContainerDef.Secrets {
-					if *x.Name == *y.Name {
-						found = true
-					}
-				}
-				if !found {
-					diff.AddChange(*y.Name, "", *y.ValueFrom)
-				}
+			if !found {
+				cd.Environment = append(cd.Environment, &ecs.KeyValuePair{Name: aws.String(key), Value: aws.String(variables[key])})
 			}
 		}
-
-		if len(diff.changes) > 0 {
-			fmt.Println(diff)
-		}
 	}
-
-	if depOpts.DryRun {
-		os.Exit(0)
-	}
-
-	rtdo, err := svc.RegisterTaskDefinition(rtdi)
-	if err != nil {
-		return s, err
-	}
-	// Update the service with the new task definition
-	usi := &ecs.UpdateServiceInput{
-		Cluster:                 dso.Services[0].ClusterArn,
-		DeploymentConfiguration: dso.Services[0].DeploymentConfiguration,
-		DesiredCount:            dso.Services[0].DesiredCount,
-		ForceNewDeployment:      aws.Bool(true),
-		NetworkConfiguration:    dso.Services[0].NetworkConfiguration,
-		PlatformVersion:         dso.Services[0].PlatformVersion,
-		Service:                 dso.Services[0].ServiceArn,
-		TaskDefinition:          rtdo.TaskDefinition.TaskDefinitionArn,
-	}
-	// If HealthCheckGracePeriodSeconds == 0 (Default), assume that the previous definition did not include a health check.
-	if dso.Services[0].HealthCheckGracePeriodSeconds != nil && *dso.Services[0].HealthCheckGracePeriodSeconds != 0 {
-		usi.HealthCheckGracePeriodSeconds = dso.Services[0].HealthCheckGracePeriodSeconds
-	}
-
-	uso, err := svc.UpdateService(usi)
-	if err != nil {
-		return s, err
-	}
-	deploymentResults.SuccessfullyInvoked = true
-	deploymentResults.ClusterArn = *uso.Service.ClusterArn
-	deploymentResults.ServiceArn = *uso.Service.ServiceArn
-	deploymentResults.ServiceName = *uso.Service.ServiceName
-	deploymentResults.TaskDefinition = *uso.Service.TaskDefinition
-
-	res, err := json.Marshal(deploymentResults)
-	s = string(res)
-	return s, err
+	return nil
 }
 
-// PerformReDeployment initiates an ECS re-deployment
-func PerformReDeployment(depOpts DeploymentOptions) (s string, err error) {
-	var deploymentResults DeploymentResults
-
-	var svc *ecs.ECS
-
-	if depOpts.Role != "" {
-		creds := stscreds.NewCredentials(sess, depOpts.Role)
-		svc = ecs.New(sess, &aws.Config{Credentials: creds})
-	} else {
-		svc = ecs.New(sess)
-	}
-
-	// Get the ECS Service
-	dsi := &ecs.DescribeServicesInput{
-		Cluster: aws.String(depOpts.Environment),
-		Services: []*string{
-			aws.String(depOpts.Application),
-		},
-	}
-	dso, err := svc.DescribeServices(dsi)
-	if err != nil {
-		return s, err
-	}
-
-	if len(dso.Failures) > 0 {
-		log.Println(dso.Failures)
-		return s, fmt.Errorf("unable to find service %s in cluster %s", depOpts.Application, depOpts.Environment)
-	}
-
-	uso, err := svc.UpdateService(&ecs.UpdateServiceInput{
-		ForceNewDeployment: aws.Bool(true),
-		Cluster:            dso.Services[0].ClusterArn,
-		Service:            dso.Services[0].ServiceArn,
-	})
-	if err != nil {
-		return s, err
+func findContainerDefinition(containerDefinitions []*ecs.ContainerDefinition, name string) *ecs.ContainerDefinition {
+	for _, cd := range containerDefinitions {
+		if cd.Name != nil && *cd.Name == name {
+			return cd
+		}
 	}
-	deploymentResults.SuccessfullyInvoked = true
-	deploymentResults.ClusterArn = *uso.Service.ClusterArn
-	deploymentResults.ServiceArn = *uso.Service.ServiceArn
-	deploymentResults.ServiceName = *uso.Service.ServiceName
-	deploymentResults.TaskDefinition = *uso.Service.TaskDefinition
-
-	res, err := json.Marshal(deploymentResults)
-	s = string(res)
-	return s, err
+	return nil
 }
 
-func WaitForDeployment(depOpts DeploymentOptions) (err error) {
-
-	var svc *ecs.ECS
-
-	if depOpts.Role != "" {
-		creds := stscreds.NewCredentials(sess, depOpts.Role)
-		svc = ecs.New(sess, &aws.Config{Credentials: creds})
-	} else {
-		svc = ecs.New(sess)
+func setImageVersion(cd *ecs.ContainerDefinition, version string) error {
+	ref, err := ParseImageReference(aws.StringValue(cd.Image))
+	if err != nil {
+		return fmt.Errorf("container %s: %v", aws.StringValue(cd.Name), err)
 	}
 
-	err = svc.WaitUntilServicesStableWithContext(aws.BackgroundContext(), &ecs.DescribeServicesInput{
-		Cluster: aws.String(depOpts.Environment),
-		Services: []*string{
-			aws.String(depOpts.Application),
-		},
-	}, request.WithWaiterMaxAttempts(depOpts.MaxAttempts))
-
+	ref, err = ref.WithVersion(version)
 	if err != nil {
-		return err
+		return fmt.Errorf("container %s: %v", aws.StringValue(cd.Name), err)
 	}
 
+	cd.Image = aws.String(ref.String())
 	return nil
 }
 
-func setDesiredVersion(depOpts DeploymentOptions) error {
-	var svc *ssm.SSM
-
-	if depOpts.Role != "" {
-		creds := stscreds.NewCredentials(sess, depOpts.Role)
-		svc = ssm.New(sess, &aws.Config{Credentials: creds})
-	} else {
-		svc = ssm.New(sess)
-	}
-
-	input := &ssm.PutParameterInput{
-		Name:        aws.String(fmt.Sprintf("/%s/%s/VERSION", depOpts.Environment, depOpts.Application)),
-		Overwrite:   aws.Bool(true),
-		Type:        aws.String("String"),
-		Description: aws.String(depOpts.Description),
-		Value:       aws.String(depOpts.Version),
-	}
-	_, err := svc.PutParameter(input)
-	return err
-}
-
-func getEcsSecretsBySSMPath(depOpts DeploymentOptions, path string) (containerSecrets []*ecs.Secret, err error) {
-	var ssmClient *ssm.SSM
-	if depOpts.Role != "" {
-		creds := stscreds.NewCredentials(sess, depOpts.Role)
-		ssmClient = ssm.New(sess, &aws.Config{Credentials: creds})
-	} else {
-		ssmClient = ssm.New(sess)
-	}
-
+func (c *Client) getEcsSecretsBySSMPath(ctx context.Context, path string) (containerSecrets []*ecs.Secret, err error) {
 	pageNum := 0
-	err = ssmClient.GetParametersByPathPages(&ssm.GetParametersByPathInput{
+	err = c.ssm.GetParametersByPathPagesWithContext(ctx, &ssm.GetParametersByPathInput{
 		Path: aws.String(path),
 	},
 		func(page *ssm.GetParametersByPathOutput, lastPage bool) bool {
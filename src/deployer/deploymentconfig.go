@@ -0,0 +1,73 @@
+package deployer
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+
+	"github.com/mitchellh/copystructure"
+)
+
+// desiredDeploymentConfiguration returns a copy of the service's deployment configuration with the circuit
+// breaker and deployment alarm settings of depOpts applied. Settings left unset keep their current values.
+func desiredDeploymentConfiguration(current *ecs.DeploymentConfiguration, depOpts DeploymentOptions) (*ecs.DeploymentConfiguration, error) {
+	desired := &ecs.DeploymentConfiguration{}
+	if current != nil {
+		copyDeploymentConfiguration, err := copystructure.Copy(current)
+		if err != nil {
+			return nil, fmt.Errorf("error performing deep copy of deployment configuration: %v", err)
+		}
+		desired = copyDeploymentConfiguration.(*ecs.DeploymentConfiguration)
+	}
+
+	if depOpts.CircuitBreaker != nil || depOpts.CircuitBreakerRollback != nil {
+		if desired.DeploymentCircuitBreaker == nil {
+			desired.DeploymentCircuitBreaker = &ecs.DeploymentCircuitBreaker{Enable: aws.Bool(false), Rollback: aws.Bool(false)}
+		}
+		if depOpts.CircuitBreaker != nil {
+			desired.DeploymentCircuitBreaker.Enable = depOpts.CircuitBreaker
+		}
+		if depOpts.CircuitBreakerRollback != nil {
+			desired.DeploymentCircuitBreaker.Rollback = depOpts.CircuitBreakerRollback
+		}
+	}
+
+	if depOpts.DeploymentAlarms != nil || depOpts.DeploymentAlarmsRollback != nil {
+		if desired.Alarms == nil {
+			desired.Alarms = &ecs.DeploymentAlarms{AlarmNames: []*string{}, Enable: aws.Bool(false), Rollback: aws.Bool(false)}
+		}
+		if depOpts.DeploymentAlarms != nil {
+			var names []string
+			for _, name := range depOpts.DeploymentAlarms {
+				if name != "" {
+					names = append(names, name)
+				}
+			}
+			// An empty list disables deployment alarms
+			desired.Alarms.Enable = aws.Bool(len(names) > 0)
+			if len(names) > 0 {
+				desired.Alarms.AlarmNames = aws.StringSlice(names)
+			}
+		}
+		if depOpts.DeploymentAlarmsRollback != nil {
+			desired.Alarms.Rollback = depOpts.DeploymentAlarmsRollback
+		}
+	}
+
+	return desired, nil
+}
+
+// rollsBackOnFailure reports whether ECS rolls a failed deployment back by itself
+func rollsBackOnFailure(deploymentConfiguration *ecs.DeploymentConfiguration) bool {
+	if deploymentConfiguration == nil {
+		return false
+	}
+	if cb := deploymentConfiguration.DeploymentCircuitBreaker; cb != nil && aws.BoolValue(cb.Enable) && aws.BoolValue(cb.Rollback) {
+		return true
+	}
+	if alarms := deploymentConfiguration.Alarms; alarms != nil && aws.BoolValue(alarms.Enable) && aws.BoolValue(alarms.Rollback) {
+		return true
+	}
+	return false
+}
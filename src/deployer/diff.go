@@ -1,7 +1,10 @@
 package deployer
 
 import (
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/fatih/color"
@@ -15,8 +18,7 @@ type Diff struct {
 }
 
 func (diff Diff) String() string {
-	fmt.Println(fmt.Sprintf("\n%s \"%s\" { ", diff.resource, diff.name))
-	return strings.Join(diff.changes, "\n") + "\n}\n"
+	return fmt.Sprintf("\n%s \"%s\" { \n", diff.resource, diff.name) + strings.Join(diff.changes, "\n") + "\n}\n"
 }
 
 func NewDiff(resource string, name string) Diff {
@@ -39,3 +41,128 @@ func (diff *Diff) AddChange(key, x, y string) {
 		diff.changes = append(diff.changes, color.YellowString(fmt.Sprintf("~\t%s =\t%s  -->  %s", key, x, y)))
 	}
 }
+
+// listIdentityKeys are the fields used, in order, to key list elements so nested lists diff stably
+// regardless of their order, e.g. environment variables by name and port mappings by container port.
+var listIdentityKeys = []string{"Name", "ContainerName", "SourceVolume", "ContainerPort", "Key"}
+
+// diffFields returns a FieldChange for every leaf field that differs between x and y, or for every
+// leaf field when full is set. Both values are compared through their JSON encoding.
+func diffFields(x, y interface{}, full bool) ([]FieldChange, error) {
+	fx, err := flatten(x)
+	if err != nil {
+		return nil, err
+	}
+	fy, err := flatten(y)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(fx)+len(fy))
+	for p := range fx {
+		paths = append(paths, p)
+	}
+	for p := range fy {
+		if _, ok := fx[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	var changes []FieldChange
+	for _, p := range paths {
+		if full || fx[p] != fy[p] {
+			changes = append(changes, FieldChange{Field: p, Old: fx[p], New: fy[p]})
+		}
+	}
+	return changes, nil
+}
+
+// flatten returns the leaf values of v keyed by their path, e.g. PortMappings[8080].HostPort
+func flatten(v interface{}) (map[string]string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var i interface{}
+	err = json.Unmarshal(b, &i)
+	if err != nil {
+		return nil, err
+	}
+
+	out := map[string]string{}
+	flattenValue("", i, out)
+	return out, nil
+}
+
+func flattenValue(path string, v interface{}, out map[string]string) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, x := range t {
+			key := k
+			if path != "" {
+				key = path + "." + key
+			}
+			flattenValue(key, x, out)
+		}
+	case []interface{}:
+		keys := listElementKeys(t)
+		for i, x := range t {
+			flattenValue(fmt.Sprintf("%s[%s]", path, keys[i]), x, out)
+		}
+	case float64:
+		out[path] = strconv.FormatFloat(t, 'f', -1, 64)
+	case nil:
+	default:
+		out[path] = fmt.Sprint(t)
+	}
+}
+
+// listElementKeys keys list elements by the first identity field that is present and unique across
+// all elements. Lists of unkeyed objects are keyed by their position once sorted by their JSON
+// encoding; lists of scalars, such as a command, keep their position because order is meaningful.
+func listElementKeys(list []interface{}) []string {
+	keys := make([]string, len(list))
+
+	for _, id := range listIdentityKeys {
+		seen := map[string]bool{}
+		for i, x := range list {
+			m, ok := x.(map[string]interface{})
+			if !ok || m[id] == nil {
+				break
+			}
+			k := fmt.Sprint(m[id])
+			if f, ok := m[id].(float64); ok {
+				k = strconv.FormatFloat(f, 'f', -1, 64)
+			}
+			if seen[k] {
+				break
+			}
+			seen[k] = true
+			keys[i] = k
+		}
+		if len(seen) == len(list) {
+			return keys
+		}
+	}
+
+	order := make([]int, len(list))
+	for i := range order {
+		order[i] = i
+	}
+	if len(list) > 0 {
+		if _, ok := list[0].(map[string]interface{}); ok {
+			encoded := make([]string, len(list))
+			for i, x := range list {
+				b, _ := json.Marshal(x)
+				encoded[i] = string(b)
+			}
+			sort.SliceStable(order, func(a, b int) bool { return encoded[order[a]] < encoded[order[b]] })
+		}
+	}
+	for position, i := range order {
+		keys[i] = strconv.Itoa(position)
+	}
+	return keys
+}
@@ -0,0 +1,201 @@
+package deployer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestDiffFields(t *testing.T) {
+	web := func(env []*ecs.KeyValuePair, ports []*ecs.PortMapping) *ecs.ContainerDefinition {
+		return &ecs.ContainerDefinition{Name: aws.String("web"), Environment: env, PortMappings: ports}
+	}
+	env := func(pairs ...string) []*ecs.KeyValuePair {
+		var kvs []*ecs.KeyValuePair
+		for i := 0; i+1 < len(pairs); i += 2 {
+			kvs = append(kvs, &ecs.KeyValuePair{Name: aws.String(pairs[i]), Value: aws.String(pairs[i+1])})
+		}
+		return kvs
+	}
+	port := func(container, host int64) *ecs.PortMapping {
+		return &ecs.PortMapping{ContainerPort: aws.Int64(container), HostPort: aws.Int64(host)}
+	}
+
+	tests := []struct {
+		name string
+		x, y interface{}
+		want []FieldChange
+	}{
+		{
+			name: "reordered environment",
+			x:    web(env("A", "1", "B", "2"), nil),
+			y:    web(env("B", "2", "A", "1"), nil),
+		},
+		{
+			name: "reordered port mappings",
+			x:    web(nil, []*ecs.PortMapping{port(80, 80), port(443, 443)}),
+			y:    web(nil, []*ecs.PortMapping{port(443, 443), port(80, 80)}),
+		},
+		{
+			name: "added and removed environment",
+			x:    web(env("A", "1", "B", "2"), nil),
+			y:    web(env("B", "2", "C", "3"), nil),
+			want: []FieldChange{
+				{Field: "Environment[A].Name", Old: "A"},
+				{Field: "Environment[A].Value", Old: "1"},
+				{Field: "Environment[C].Name", New: "C"},
+				{Field: "Environment[C].Value", New: "3"},
+			},
+		},
+		{
+			name: "changed port mapping",
+			x:    web(nil, []*ecs.PortMapping{port(8080, 80)}),
+			y:    web(nil, []*ecs.PortMapping{port(8080, 8080)}),
+			want: []FieldChange{{Field: "PortMappings[8080].HostPort", Old: "80", New: "8080"}},
+		},
+		{
+			name: "nested map",
+			x:    &ecs.LogConfiguration{LogDriver: aws.String("awslogs"), Options: map[string]*string{"awslogs-group": aws.String("app"), "awslogs-region": aws.String("us-east-1")}},
+			y:    &ecs.LogConfiguration{LogDriver: aws.String("awslogs"), Options: map[string]*string{"awslogs-group": aws.String("app-v2"), "mode": aws.String("non-blocking")}},
+			want: []FieldChange{
+				{Field: "Options.awslogs-group", Old: "app", New: "app-v2"},
+				{Field: "Options.awslogs-region", Old: "us-east-1"},
+				{Field: "Options.mode", New: "non-blocking"},
+			},
+		},
+		{
+			// A command's arguments are positional, so reordering them is a change
+			name: "reordered command",
+			x:    &ecs.ContainerDefinition{Command: aws.StringSlice([]string{"serve", "--port"})},
+			y:    &ecs.ContainerDefinition{Command: aws.StringSlice([]string{"--port", "serve"})},
+			want: []FieldChange{
+				{Field: "Command[0]", Old: "serve", New: "--port"},
+				{Field: "Command[1]", Old: "--port", New: "serve"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := diffFields(test.x, test.y, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("diffFields() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	got, err := flatten(&ecs.ContainerDefinition{
+		Name:         aws.String("web"),
+		Cpu:          aws.Int64(256),
+		Essential:    aws.Bool(true),
+		PortMappings: []*ecs.PortMapping{{ContainerPort: aws.Int64(8080), Protocol: aws.String("tcp")}},
+		DockerLabels: map[string]*string{"team": aws.String("payments")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"Name":                             "web",
+		"Cpu":                              "256",
+		"Essential":                        "true",
+		"PortMappings[8080].ContainerPort": "8080",
+		"PortMappings[8080].Protocol":      "tcp",
+		"DockerLabels.team":                "payments",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("flatten() = %v, want %v", got, want)
+	}
+}
+
+func TestListElementKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		list []interface{}
+		want []string
+	}{
+		{
+			name: "by name",
+			list: []interface{}{map[string]interface{}{"Name": "B"}, map[string]interface{}{"Name": "A"}},
+			want: []string{"B", "A"},
+		},
+		{
+			name: "by container port",
+			list: []interface{}{map[string]interface{}{"ContainerPort": float64(443)}, map[string]interface{}{"ContainerPort": float64(80)}},
+			want: []string{"443", "80"},
+		},
+		{
+			// Duplicate names fall through to the next identity field
+			name: "duplicate names",
+			list: []interface{}{
+				map[string]interface{}{"Name": "web", "ContainerPort": float64(80)},
+				map[string]interface{}{"Name": "web", "ContainerPort": float64(443)},
+			},
+			want: []string{"80", "443"},
+		},
+		{
+			name: "unkeyed objects",
+			list: []interface{}{map[string]interface{}{"Value": "b"}, map[string]interface{}{"Value": "a"}},
+			want: []string{"1", "0"},
+		},
+		{
+			name: "scalars",
+			list: []interface{}{"b", "a"},
+			want: []string{"0", "1"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := listElementKeys(test.list)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("listElementKeys() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDiffContainerSecrets(t *testing.T) {
+	const prefix = "arn:aws:ssm:us-east-1:123456789012:parameter/prd/app/"
+	secrets := func(names ...string) []*ecs.Secret {
+		var s []*ecs.Secret
+		for _, name := range names {
+			s = append(s, &ecs.Secret{Name: aws.String(name), ValueFrom: aws.String(prefix + name)})
+		}
+		return s
+	}
+	current := &ecs.ContainerDefinition{Name: aws.String("web"), Secrets: secrets("DB_PASSWORD", "API_KEY")}
+	desired := &ecs.ContainerDefinition{Name: aws.String("web"), Secrets: append(secrets("API_KEY", "TOKEN"),
+		&ecs.Secret{Name: aws.String("DB_PASSWORD"), ValueFrom: aws.String(prefix + "v2/DB_PASSWORD")})}
+
+	cc, err := diffContainerDefinitions(current, desired, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Secrets are diffed by the parameter they are read from, never by their value, and not as fields
+	if len(cc.Changes) != 0 {
+		t.Errorf("Changes = %+v, want secrets reported separately", cc.Changes)
+	}
+	if want := []SecretChange{{Name: "DB_PASSWORD", Old: prefix + "DB_PASSWORD", New: prefix + "v2/DB_PASSWORD"}}; !reflect.DeepEqual(cc.SecretsChanged, want) {
+		t.Errorf("SecretsChanged = %+v, want %+v", cc.SecretsChanged, want)
+	}
+	if want := []SecretChange{{Name: "TOKEN", New: prefix + "TOKEN"}}; !reflect.DeepEqual(cc.SecretsAdded, want) {
+		t.Errorf("SecretsAdded = %+v, want %+v", cc.SecretsAdded, want)
+	}
+	if cc.SecretsRemoved != nil || cc.SecretsUnchanged != nil {
+		t.Errorf("SecretsRemoved = %+v, SecretsUnchanged = %+v, want none", cc.SecretsRemoved, cc.SecretsUnchanged)
+	}
+
+	plan := &Plan{TaskDefinition: &ecs.RegisterTaskDefinitionInput{Family: aws.String("app")}, Containers: []ContainerChanges{cc}}
+	rendered := plan.String()
+	if !strings.Contains(rendered, prefix+"TOKEN") {
+		t.Errorf("plan does not render the added secret's parameter:\n%s", rendered)
+	}
+}
@@ -0,0 +1,151 @@
+package deployer
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// ecrRegistryRegexp matches ECR registry hosts, capturing the account id and region
+var ecrRegistryRegexp = regexp.MustCompile(`^(\d{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+// maxTagSuggestions is the number of existing tags suggested when an image tag is not found
+const maxTagSuggestions = 5
+
+// verifyImagesExist checks that every changed ECR image in desired exists before a new revision is registered
+func (c *Client) verifyImagesExist(ctx context.Context, current, desired []*ecs.ContainerDefinition) error {
+	for index, cd := range desired {
+		if index < len(current) && aws.StringValue(current[index].Image) == aws.StringValue(cd.Image) {
+			continue
+		}
+
+		ref, err := ParseImageReference(aws.StringValue(cd.Image))
+		if err != nil {
+			return fmt.Errorf("container %s: %v", aws.StringValue(cd.Name), err)
+		}
+
+		err = c.verifyECRImageExists(ctx, ref)
+		if err != nil {
+			return fmt.Errorf("container %s: %v", aws.StringValue(cd.Name), err)
+		}
+	}
+	return nil
+}
+
+// verifyECRImageExists looks up the tag or digest of an ECR image. Images hosted outside ECR are not checked.
+func (c *Client) verifyECRImageExists(ctx context.Context, ref ImageReference) error {
+	m := ecrRegistryRegexp.FindStringSubmatch(ref.Registry)
+	if m == nil {
+		return nil
+	}
+	registryID, region := m[1], m[2]
+
+	svc := c.ecrFor(region)
+
+	imageID := &ecr.ImageIdentifier{}
+	if ref.Digest != "" {
+		imageID.ImageDigest = aws.String(ref.Digest)
+	} else {
+		imageID.ImageTag = aws.String(ref.Tag)
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		imageID.ImageTag = aws.String("latest")
+	}
+
+	_, err := svc.DescribeImagesWithContext(ctx, &ecr.DescribeImagesInput{
+		RegistryId:     aws.String(registryID),
+		RepositoryName: aws.String(ref.Repository),
+		ImageIds:       []*ecr.ImageIdentifier{imageID},
+	})
+	if err == nil {
+		return nil
+	}
+
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ecr.ErrCodeImageNotFoundException {
+		if ref.Digest != "" {
+			return fmt.Errorf("image %s not found in ECR", ref)
+		}
+
+		tags, lerr := listECRImageTags(ctx, svc, registryID, ref.Repository)
+		if lerr != nil || len(tags) == 0 {
+			return fmt.Errorf("image %s not found in ECR", ref)
+		}
+		return fmt.Errorf("image %s not found in ECR. Did you mean one of: %s", ref, strings.Join(nearestTags(aws.StringValue(imageID.ImageTag), tags, maxTagSuggestions), ", "))
+	}
+
+	return fmt.Errorf("unable to verify image %s: %v", ref, err)
+}
+
+func listECRImageTags(ctx context.Context, svc ecriface.ECRAPI, registryID, repository string) (tags []string, err error) {
+	pageNum := 0
+	err = svc.ListImagesPagesWithContext(ctx, &ecr.ListImagesInput{
+		RegistryId:     aws.String(registryID),
+		RepositoryName: aws.String(repository),
+		Filter:         &ecr.ListImagesFilter{TagStatus: aws.String(ecr.TagStatusTagged)},
+	},
+		func(page *ecr.ListImagesOutput, lastPage bool) bool {
+			pageNum++
+			for _, v := range page.ImageIds {
+				if v.ImageTag != nil {
+					tags = append(tags, *v.ImageTag)
+				}
+			}
+			return pageNum <= 100
+		})
+	return
+}
+
+// nearestTags returns up to n tags ordered by edit distance from tag
+func nearestTags(tag string, tags []string, n int) []string {
+	distances := make(map[string]int, len(tags))
+	for _, t := range tags {
+		distances[t] = levenshtein(tag, t)
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool {
+		if distances[tags[i]] == distances[tags[j]] {
+			return tags[i] < tags[j]
+		}
+		return distances[tags[i]] < distances[tags[j]]
+	})
+
+	if len(tags) > n {
+		tags = tags[:n]
+	}
+	return tags
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j] + 1
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+			if prev[j-1]+cost < curr[j] {
+				curr[j] = prev[j-1] + cost
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,216 @@
+package deployer
+
+import (
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/codedeploy/codedeployiface"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+const (
+	testTaskDefinitionArn    = "arn:aws:ecs:us-east-1:123456789012:task-definition/app:7"
+	testNewTaskDefinitionArn = "arn:aws:ecs:us-east-1:123456789012:task-definition/app:8"
+	testPrimaryTaskSetArn    = "arn:aws:ecs:us-east-1:123456789012:task-set/prd/app/ecs-svc/primary"
+	testCanaryTaskSetArn     = "arn:aws:ecs:us-east-1:123456789012:task-set/prd/app/ecs-svc/canary"
+)
+
+// fakeECS serves a single service running testTaskDefinitionArn. Calls it does not implement panic.
+type fakeECS struct {
+	ecsiface.ECSAPI
+	service        *ecs.Service
+	taskDefinition *ecs.TaskDefinition
+	registered     *ecs.RegisterTaskDefinitionInput
+	updated        *ecs.UpdateServiceInput
+	// createdTaskSet and deletedTaskSets record the task set calls of EXTERNAL services
+	createdTaskSet  *ecs.CreateTaskSetInput
+	deletedTaskSets []string
+}
+
+func (f *fakeECS) DescribeServicesWithContext(ctx aws.Context, input *ecs.DescribeServicesInput, opts ...request.Option) (*ecs.DescribeServicesOutput, error) {
+	if aws.StringValue(input.Services[0]) != aws.StringValue(f.service.ServiceName) {
+		return &ecs.DescribeServicesOutput{Failures: []*ecs.Failure{{Arn: input.Services[0], Reason: aws.String("MISSING")}}}, nil
+	}
+	return &ecs.DescribeServicesOutput{Services: []*ecs.Service{f.service}}, nil
+}
+
+func (f *fakeECS) DescribeTaskDefinitionWithContext(ctx aws.Context, input *ecs.DescribeTaskDefinitionInput, opts ...request.Option) (*ecs.DescribeTaskDefinitionOutput, error) {
+	return &ecs.DescribeTaskDefinitionOutput{TaskDefinition: f.taskDefinition}, nil
+}
+
+func (f *fakeECS) ListTagsForResourceWithContext(ctx aws.Context, input *ecs.ListTagsForResourceInput, opts ...request.Option) (*ecs.ListTagsForResourceOutput, error) {
+	return &ecs.ListTagsForResourceOutput{Tags: []*ecs.Tag{{Key: aws.String("team"), Value: aws.String("payments")}}}, nil
+}
+
+func (f *fakeECS) RegisterTaskDefinitionWithContext(ctx aws.Context, input *ecs.RegisterTaskDefinitionInput, opts ...request.Option) (*ecs.RegisterTaskDefinitionOutput, error) {
+	f.registered = input
+	return &ecs.RegisterTaskDefinitionOutput{TaskDefinition: &ecs.TaskDefinition{TaskDefinitionArn: aws.String(testNewTaskDefinitionArn)}}, nil
+}
+
+func (f *fakeECS) UpdateServiceWithContext(ctx aws.Context, input *ecs.UpdateServiceInput, opts ...request.Option) (*ecs.UpdateServiceOutput, error) {
+	f.updated = input
+	service := *f.service
+	service.TaskDefinition = input.TaskDefinition
+	service.DesiredCount = input.DesiredCount
+	return &ecs.UpdateServiceOutput{Service: &service}, nil
+}
+
+func (f *fakeECS) CreateTaskSetWithContext(ctx aws.Context, input *ecs.CreateTaskSetInput, opts ...request.Option) (*ecs.CreateTaskSetOutput, error) {
+	f.createdTaskSet = input
+	taskSet := &ecs.TaskSet{
+		Id:                   aws.String("ecs-svc/canary"),
+		TaskSetArn:           aws.String(testCanaryTaskSetArn),
+		Status:               aws.String("ACTIVE"),
+		TaskDefinition:       input.TaskDefinition,
+		Scale:                input.Scale,
+		StabilityStatus:      aws.String(ecs.StabilityStatusSteadyState),
+		RunningCount:         aws.Int64(1),
+		ComputedDesiredCount: aws.Int64(1),
+	}
+	f.service.TaskSets = append(f.service.TaskSets, taskSet)
+	return &ecs.CreateTaskSetOutput{TaskSet: taskSet}, nil
+}
+
+func (f *fakeECS) UpdateServicePrimaryTaskSetWithContext(ctx aws.Context, input *ecs.UpdateServicePrimaryTaskSetInput, opts ...request.Option) (*ecs.UpdateServicePrimaryTaskSetOutput, error) {
+	for _, ts := range f.service.TaskSets {
+		if aws.StringValue(ts.TaskSetArn) == aws.StringValue(input.PrimaryTaskSet) {
+			ts.Status = aws.String("PRIMARY")
+		} else {
+			ts.Status = aws.String("ACTIVE")
+		}
+	}
+	return &ecs.UpdateServicePrimaryTaskSetOutput{}, nil
+}
+
+func (f *fakeECS) UpdateTaskSetWithContext(ctx aws.Context, input *ecs.UpdateTaskSetInput, opts ...request.Option) (*ecs.UpdateTaskSetOutput, error) {
+	findTaskSet(f.service, aws.StringValue(input.TaskSet)).Scale = input.Scale
+	return &ecs.UpdateTaskSetOutput{}, nil
+}
+
+func (f *fakeECS) DeleteTaskSetWithContext(ctx aws.Context, input *ecs.DeleteTaskSetInput, opts ...request.Option) (*ecs.DeleteTaskSetOutput, error) {
+	f.deletedTaskSets = append(f.deletedTaskSets, aws.StringValue(input.TaskSet))
+	var taskSets []*ecs.TaskSet
+	for _, ts := range f.service.TaskSets {
+		if aws.StringValue(ts.TaskSetArn) != aws.StringValue(input.TaskSet) {
+			taskSets = append(taskSets, ts)
+		}
+	}
+	f.service.TaskSets = taskSets
+	return &ecs.DeleteTaskSetOutput{}, nil
+}
+
+// fakeSSM holds parameters in memory. Calls it does not implement panic.
+type fakeSSM struct {
+	ssmiface.SSMAPI
+	parameters map[string]string
+	putErr     error
+	deleteErr  error
+}
+
+func (f *fakeSSM) GetParameterWithContext(ctx aws.Context, input *ssm.GetParameterInput, opts ...request.Option) (*ssm.GetParameterOutput, error) {
+	value, ok := f.parameters[aws.StringValue(input.Name)]
+	if !ok {
+		return nil, awserr.New(ssm.ErrCodeParameterNotFound, "parameter not found", nil)
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Name: input.Name, Value: aws.String(value)}}, nil
+}
+
+func (f *fakeSSM) PutParameterWithContext(ctx aws.Context, input *ssm.PutParameterInput, opts ...request.Option) (*ssm.PutParameterOutput, error) {
+	if f.putErr != nil {
+		return nil, f.putErr
+	}
+	if _, ok := f.parameters[aws.StringValue(input.Name)]; ok && !aws.BoolValue(input.Overwrite) {
+		return nil, awserr.New(ssm.ErrCodeParameterAlreadyExists, "parameter already exists", nil)
+	}
+	f.parameters[aws.StringValue(input.Name)] = aws.StringValue(input.Value)
+	return &ssm.PutParameterOutput{}, nil
+}
+
+func (f *fakeSSM) DeleteParameterWithContext(ctx aws.Context, input *ssm.DeleteParameterInput, opts ...request.Option) (*ssm.DeleteParameterOutput, error) {
+	if f.deleteErr != nil {
+		return nil, f.deleteErr
+	}
+	if _, ok := f.parameters[aws.StringValue(input.Name)]; !ok {
+		return nil, awserr.New(ssm.ErrCodeParameterNotFound, "parameter not found", nil)
+	}
+	delete(f.parameters, aws.StringValue(input.Name))
+	return &ssm.DeleteParameterOutput{}, nil
+}
+
+func newFakeECS() *fakeECS {
+	return &fakeECS{
+		service: &ecs.Service{
+			ClusterArn:     aws.String("arn:aws:ecs:us-east-1:123456789012:cluster/prd"),
+			ServiceArn:     aws.String("arn:aws:ecs:us-east-1:123456789012:service/prd/app"),
+			ServiceName:    aws.String("app"),
+			TaskDefinition: aws.String(testTaskDefinitionArn),
+			DesiredCount:   aws.Int64(2),
+		},
+		taskDefinition: &ecs.TaskDefinition{
+			TaskDefinitionArn: aws.String(testTaskDefinitionArn),
+			Family:            aws.String("app"),
+			Revision:          aws.Int64(7),
+			Cpu:               aws.String("256"),
+			Memory:            aws.String("512"),
+			ContainerDefinitions: []*ecs.ContainerDefinition{
+				{
+					Name:        aws.String("web"),
+					Image:       aws.String("registry.local:5000/team/app:1.1"),
+					Environment: []*ecs.KeyValuePair{{Name: aws.String("LOG_LEVEL"), Value: aws.String("info")}},
+				},
+				{
+					Name:  aws.String("worker"),
+					Image: aws.String("registry.local:5000/team/worker:1.1"),
+				},
+			},
+		},
+	}
+}
+
+// newFakeExternalECS serves a service using the EXTERNAL deployment controller, whose primary task set runs
+// testTaskDefinitionArn. The service itself has no task definition.
+func newFakeExternalECS() *fakeECS {
+	f := newFakeECS()
+	f.service.DeploymentController = &ecs.DeploymentController{Type: aws.String(ecs.DeploymentControllerTypeExternal)}
+	f.service.TaskDefinition = nil
+	f.service.TaskSets = []*ecs.TaskSet{{
+		Id:                   aws.String("ecs-svc/primary"),
+		TaskSetArn:           aws.String(testPrimaryTaskSetArn),
+		Status:               aws.String("PRIMARY"),
+		TaskDefinition:       aws.String(testTaskDefinitionArn),
+		LaunchType:           aws.String(ecs.LaunchTypeFargate),
+		Scale:                &ecs.Scale{Unit: aws.String(ecs.ScaleUnitPercent), Value: aws.Float64(100)},
+		StabilityStatus:      aws.String(ecs.StabilityStatusSteadyState),
+		RunningCount:         aws.Int64(2),
+		ComputedDesiredCount: aws.Int64(2),
+	}}
+	return f
+}
+
+// newFakeClient builds a client on fakes; the clients a test does not expect to be called are left unimplemented.
+// opts are applied after the fakes, e.g. to set the HTTP client.
+func newFakeClient(t *testing.T, ecsAPI ecsiface.ECSAPI, ssmAPI ssmiface.SSMAPI, opts ...Option) *Client {
+	t.Helper()
+	client, err := NewClient(append([]Option{
+		WithECS(ecsAPI),
+		WithSSM(ssmAPI),
+		WithCloudWatch(struct{ cloudwatchiface.CloudWatchAPI }{}),
+		WithCodeDeploy(struct{ codedeployiface.CodeDeployAPI }{}),
+		WithELBV2(struct{ elbv2iface.ELBV2API }{}),
+		WithECR(struct{ ecriface.ECRAPI }{}),
+		WithOutput(io.Discard),
+	}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
@@ -0,0 +1,42 @@
+package deployer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// CheckHealthy returns an error unless the service is stable with every task healthy in its load balancer target
+// groups (unless SkipTargetHealth is set) and none of the BakeAlarms is in ALARM. Unlike WaitForDeployment it checks
+// once, e.g. to gate the next wave of a deployment on the services already deployed.
+func (c *Client) CheckHealthy(ctx context.Context, depOpts DeploymentOptions) error {
+	service, err := c.describeService(ctx, depOpts)
+	if err != nil {
+		return err
+	}
+
+	// Services deployed with CodeDeploy or as task sets have no deployments, only task sets
+	if len(service.TaskSets) > 0 {
+		for _, ts := range service.TaskSets {
+			if aws.StringValue(ts.StabilityStatus) != ecs.StabilityStatusSteadyState || aws.Int64Value(ts.RunningCount) != aws.Int64Value(ts.ComputedDesiredCount) {
+				return fmt.Errorf("service %s in %s is not stable: task set %s running %d/%d, %s", depOpts.Application, depOpts.Environment,
+					aws.StringValue(ts.Id), aws.Int64Value(ts.RunningCount), aws.Int64Value(ts.ComputedDesiredCount), aws.StringValue(ts.StabilityStatus))
+			}
+		}
+	} else {
+		if !serviceIsStable(service) {
+			return fmt.Errorf("service %s in %s is not stable: %d deployments, running %d/%d", depOpts.Application, depOpts.Environment,
+				len(service.Deployments), aws.Int64Value(service.RunningCount), aws.Int64Value(service.DesiredCount))
+		}
+		if !depOpts.SkipTargetHealth {
+			err = c.checkDeploymentTargetHealth(ctx, service, aws.StringValue(service.Deployments[0].Id))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return c.checkAlarms(ctx, depOpts.BakeAlarms)
+}
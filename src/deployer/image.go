@@ -0,0 +1,124 @@
+package deployer
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// digestRegexp matches an image digest such as sha256:<hex>
+	digestRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}$`)
+	// tagRegexp matches a valid image tag
+	tagRegexp = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+)
+
+// ImageReference is a parsed container image reference, e.g. registry.local:5000/team/app:1.2@sha256:...
+type ImageReference struct {
+	// Registry host with optional port. Empty for Docker Hub images without an explicit registry
+	Registry string
+	// Repository path within the registry, e.g. team/app
+	Repository string
+	// Tag of the image, e.g. 1.2
+	Tag string
+	// Digest of the image, e.g. sha256:...
+	Digest string
+}
+
+// ParseImageReference splits an image reference into its registry, repository, tag and digest
+func ParseImageReference(image string) (ref ImageReference, err error) {
+	if image == "" {
+		return ref, fmt.Errorf("invalid image reference: empty")
+	}
+
+	remainder := image
+	if i := strings.Index(remainder, "@"); i != -1 {
+		ref.Digest = remainder[i+1:]
+		remainder = remainder[:i]
+		if !digestRegexp.MatchString(ref.Digest) {
+			return ref, fmt.Errorf("invalid image reference %s: invalid digest %s", image, ref.Digest)
+		}
+	}
+
+	// The first path component is a registry when it looks like a host: it has a dot, a port, or is localhost
+	if i := strings.Index(remainder, "/"); i != -1 {
+		host := remainder[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.Registry = host
+			remainder = remainder[i+1:]
+		}
+	}
+
+	// A tag can only follow the last path component, so a registry port is never mistaken for one
+	if i := strings.LastIndex(remainder, ":"); i != -1 && i > strings.LastIndex(remainder, "/") {
+		ref.Tag = remainder[i+1:]
+		remainder = remainder[:i]
+		if !tagRegexp.MatchString(ref.Tag) {
+			return ref, fmt.Errorf("invalid image reference %s: invalid tag %s", image, ref.Tag)
+		}
+	}
+
+	ref.Repository = remainder
+	if ref.Repository == "" || strings.HasPrefix(ref.Repository, "/") || strings.HasSuffix(ref.Repository, "/") || strings.Contains(ref.Repository, "//") {
+		return ref, fmt.Errorf("invalid image reference %s: invalid repository", image)
+	}
+
+	return ref, nil
+}
+
+// Name returns the registry and repository without a tag or digest
+func (ref ImageReference) Name() string {
+	if ref.Registry == "" {
+		return ref.Repository
+	}
+	return ref.Registry + "/" + ref.Repository
+}
+
+// Version returns the tag, the digest, or tag@digest when both are set
+func (ref ImageReference) Version() string {
+	switch {
+	case ref.Tag != "" && ref.Digest != "":
+		return ref.Tag + "@" + ref.Digest
+	case ref.Digest != "":
+		return ref.Digest
+	default:
+		return ref.Tag
+	}
+}
+
+func (ref ImageReference) String() string {
+	s := ref.Name()
+	if ref.Tag != "" {
+		s += ":" + ref.Tag
+	}
+	if ref.Digest != "" {
+		s += "@" + ref.Digest
+	}
+	return s
+}
+
+// WithVersion returns a copy of ref pointing at version. The version may be
+// a tag (1.2.3), a digest (sha256:...) or both (1.2.3@sha256:...); any tag or
+// digest already on the image is replaced so a stale digest never pins the old image.
+func (ref ImageReference) WithVersion(version string) (ImageReference, error) {
+	tag, digest := version, ""
+	if i := strings.Index(version, "@"); i != -1 {
+		tag, digest = version[:i], version[i+1:]
+	} else if digestRegexp.MatchString(version) {
+		tag, digest = "", version
+	}
+
+	if tag != "" && !tagRegexp.MatchString(tag) {
+		return ref, fmt.Errorf("invalid version %s: invalid tag %s", version, tag)
+	}
+	if digest != "" && !digestRegexp.MatchString(digest) {
+		return ref, fmt.Errorf("invalid version %s: invalid digest %s", version, digest)
+	}
+	if tag == "" && digest == "" {
+		return ref, fmt.Errorf("invalid version: empty")
+	}
+
+	ref.Tag = tag
+	ref.Digest = digest
+	return ref, nil
+}
@@ -0,0 +1,101 @@
+package deployer
+
+import (
+	"testing"
+)
+
+const testDigest = "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+func TestParseImageReference(t *testing.T) {
+	tests := []struct {
+		image   string
+		want    ImageReference
+		wantErr bool
+	}{
+		{image: "app", want: ImageReference{Repository: "app"}},
+		{image: "app:1.2", want: ImageReference{Repository: "app", Tag: "1.2"}},
+		{image: "library/nginx:1.25", want: ImageReference{Repository: "library/nginx", Tag: "1.25"}},
+		{image: "team/app", want: ImageReference{Repository: "team/app"}},
+		{image: "registry.local:5000/team/app:1.2", want: ImageReference{Registry: "registry.local:5000", Repository: "team/app", Tag: "1.2"}},
+		{image: "registry.local:5000/team/app", want: ImageReference{Registry: "registry.local:5000", Repository: "team/app"}},
+		{image: "localhost/app", want: ImageReference{Registry: "localhost", Repository: "app"}},
+		{image: "localhost:5000/app:dev", want: ImageReference{Registry: "localhost:5000", Repository: "app", Tag: "dev"}},
+		{image: "123456789012.dkr.ecr.us-east-1.amazonaws.com/app:1.2", want: ImageReference{Registry: "123456789012.dkr.ecr.us-east-1.amazonaws.com", Repository: "app", Tag: "1.2"}},
+		{image: "repo@" + testDigest, want: ImageReference{Repository: "repo", Digest: testDigest}},
+		{image: "app:1.2@" + testDigest, want: ImageReference{Repository: "app", Tag: "1.2", Digest: testDigest}},
+		{image: "registry.local:5000/team/app:1.2@" + testDigest, want: ImageReference{Registry: "registry.local:5000", Repository: "team/app", Tag: "1.2", Digest: testDigest}},
+
+		{image: "", wantErr: true},
+		{image: "app:", wantErr: true},
+		{image: "app:-bad", wantErr: true},
+		{image: "app@sha256:short", wantErr: true},
+		{image: "app@" + testDigest[7:], wantErr: true},
+		{image: "app@", wantErr: true},
+		{image: "team//app", wantErr: true},
+		{image: "registry.local/", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.image, func(t *testing.T) {
+			got, err := ParseImageReference(test.image)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("ParseImageReference(%q) = %+v, want an error", test.image, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseImageReference(%q): %v", test.image, err)
+			}
+			if got != test.want {
+				t.Fatalf("ParseImageReference(%q) = %+v, want %+v", test.image, got, test.want)
+			}
+			if got.String() != test.image {
+				t.Errorf("String() = %q, want %q", got.String(), test.image)
+			}
+		})
+	}
+}
+
+func TestImageReferenceWithVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		image   string
+		version string
+		want    string
+		wantErr bool
+	}{
+		{name: "tag", image: "app:1.1", version: "1.2", want: "app:1.2"},
+		{name: "registry port", image: "registry.local:5000/team/app:1.1", version: "1.2", want: "registry.local:5000/team/app:1.2"},
+		{name: "untagged", image: "localhost/app", version: "1.2", want: "localhost/app:1.2"},
+		{name: "digest", image: "app:1.1", version: testDigest, want: "app@" + testDigest},
+		{name: "tag and digest", image: "app", version: "1.2@" + testDigest, want: "app:1.2@" + testDigest},
+		{name: "stale digest replaced by tag", image: "app:1.1@" + testDigest, version: "1.2", want: "app:1.2"},
+		{name: "stale digest replaced by digest", image: "app@" + testDigest, version: "sha256:" + "0123456789abcdef0123456789abcdef", want: "app@sha256:0123456789abcdef0123456789abcdef"},
+
+		{name: "empty", image: "app:1.1", version: "", wantErr: true},
+		{name: "invalid tag", image: "app:1.1", version: "-1.2", wantErr: true},
+		{name: "invalid digest", image: "app:1.1", version: "1.2@sha256:short", wantErr: true},
+		{name: "empty tag and digest", image: "app:1.1", version: "@", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ref, err := ParseImageReference(test.image)
+			if err != nil {
+				t.Fatalf("ParseImageReference(%q): %v", test.image, err)
+			}
+			got, err := ref.WithVersion(test.version)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("WithVersion(%q) = %s, want an error", test.version, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("WithVersion(%q): %v", test.version, err)
+			}
+			if got.String() != test.want {
+				t.Errorf("WithVersion(%q) = %s, want %s", test.version, got, test.want)
+			}
+		})
+	}
+}
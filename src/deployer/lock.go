@@ -0,0 +1,229 @@
+package deployer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+const (
+	// lockParameterPrefix is the SSM path deployment locks are written under, as <prefix>/<cluster>/<service>
+	lockParameterPrefix = "/ecs-deploy/lock"
+	// defaultLockTTL is used when DeploymentOptions.LockTTL is not set
+	defaultLockTTL = time.Hour
+)
+
+// Lock is a deployment lock on a service, stored as an SSM parameter so concurrent deployments of the service are serialized.
+// A lock older than its TTL is considered abandoned and is taken over by the next deployment. The lock is not renewed,
+// so a deployment running longer than its TTL can lose it; set LockTTL above the longest deployment.
+//
+// SSM has no conditional delete, so taking over an abandoned lock and releasing a lock read the parameter, compare its
+// ID and then delete it. A deployment that takes the lock between the read and the delete loses it, and two deployments
+// can then run at once. The window is a single API round trip, and only opens once a lock has expired or is released.
+type Lock struct {
+	// Parameter is the SSM parameter holding the lock
+	Parameter string `json:"-"`
+	// ID distinguishes this lock from a later one taken by the same owner
+	ID       string    `json:"ID"`
+	Owner    string    `json:"Owner"`
+	Acquired time.Time `json:"Acquired"`
+	TTL      Duration  `json:"TTL"`
+}
+
+// Expires is when the lock is considered abandoned
+func (lock *Lock) Expires() time.Time {
+	return lock.Acquired.Add(time.Duration(lock.TTL))
+}
+
+func (lock *Lock) String() string {
+	return fmt.Sprintf("%s since %s (expires %s)", lock.Owner, lock.Acquired.Local().Format(time.RFC3339), lock.Expires().Local().Format(time.RFC3339))
+}
+
+// LockedError is returned when a service is locked by another deployment for longer than LockTimeout
+type LockedError struct {
+	Service string
+	Holder  *Lock
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("service %s is locked by %s", e.Service, e.Holder)
+}
+
+// DefaultLockOwner identifies the current process as <user>@<host>
+func DefaultLockOwner() string {
+	owner := "unknown"
+	if u, err := user.Current(); err == nil {
+		owner = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s@%s", owner, host)
+}
+
+// lockParameterName returns the SSM parameter locking the service of depOpts
+func lockParameterName(depOpts DeploymentOptions) string {
+	return fmt.Sprintf("%s/%s/%s", lockParameterPrefix, depOpts.Environment, depOpts.Application)
+}
+
+// AcquireLock locks the service of depOpts, waiting up to LockTimeout for another deployment to release it.
+// It returns a *LockedError when the service is still locked after LockTimeout.
+func (c *Client) AcquireLock(ctx context.Context, depOpts DeploymentOptions) (*Lock, error) {
+	ttl := depOpts.LockTTL
+	if ttl <= 0 {
+		ttl = Duration(defaultLockTTL)
+	}
+	owner := depOpts.LockOwner
+	if owner == "" {
+		owner = DefaultLockOwner()
+	}
+
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(time.Duration(depOpts.LockTimeout))
+	for {
+		lock := &Lock{
+			Parameter: lockParameterName(depOpts),
+			ID:        hex.EncodeToString(id),
+			Owner:     owner,
+			Acquired:  time.Now().UTC(),
+			TTL:       ttl,
+		}
+		value, err := json.Marshal(lock)
+		if err != nil {
+			return nil, err
+		}
+
+		// Creating the parameter only succeeds when no other deployment holds it
+		_, err = c.ssm.PutParameterWithContext(ctx, &ssm.PutParameterInput{
+			Name:        aws.String(lock.Parameter),
+			Overwrite:   aws.Bool(false),
+			Type:        aws.String("String"),
+			Description: aws.String("ecs-deploy deployment lock"),
+			Value:       aws.String(string(value)),
+		})
+		if err == nil {
+			return lock, nil
+		}
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != ssm.ErrCodeParameterAlreadyExists {
+			return nil, err
+		}
+
+		holder, err := c.getLock(ctx, lock.Parameter)
+		if err != nil {
+			return nil, err
+		}
+		if holder == nil {
+			// Released in the meantime
+			continue
+		}
+		if time.Now().After(holder.Expires()) {
+			fmt.Fprintf(c.out, "Taking over lock abandoned by %s\n", holder)
+			err = c.deleteAbandonedLock(ctx, holder)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, &LockedError{Service: depOpts.Application, Holder: holder}
+		}
+		fmt.Fprintf(c.out, "Waiting for lock held by %s\n", holder)
+
+		interval := c.waitInterval
+		if remaining < interval {
+			interval = remaining
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// ReleaseLock releases a lock taken by AcquireLock. A lock that has since been taken over by another deployment is left alone.
+func (c *Client) ReleaseLock(ctx context.Context, lock *Lock) error {
+	holder, err := c.getLock(ctx, lock.Parameter)
+	if err != nil {
+		return err
+	}
+	if holder == nil || holder.ID != lock.ID {
+		return nil
+	}
+	return c.deleteLock(ctx, lock.Parameter)
+}
+
+// ForceUnlock removes the lock on the service of depOpts whoever holds it, returning the removed lock or nil when the service was not locked
+func (c *Client) ForceUnlock(ctx context.Context, depOpts DeploymentOptions) (*Lock, error) {
+	holder, err := c.GetLock(ctx, depOpts)
+	if err != nil || holder == nil {
+		return nil, err
+	}
+	return holder, c.deleteLock(ctx, holder.Parameter)
+}
+
+// GetLock returns the lock on the service of depOpts, or nil when it is not locked
+func (c *Client) GetLock(ctx context.Context, depOpts DeploymentOptions) (*Lock, error) {
+	return c.getLock(ctx, lockParameterName(depOpts))
+}
+
+// getLock returns the lock held in the parameter, or nil when it does not exist
+func (c *Client) getLock(ctx context.Context, name string) (*Lock, error) {
+	gpo, err := c.ssm.GetParameterWithContext(ctx, &ssm.GetParameterInput{
+		Name: aws.String(name),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeParameterNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &Lock{Parameter: name}
+	err = json.Unmarshal([]byte(aws.StringValue(gpo.Parameter.Value)), lock)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lock in %s: %v", name, err)
+	}
+	return lock, nil
+}
+
+// deleteAbandonedLock deletes an expired lock, unless another deployment has taken it over since it was read:
+// that deployment's lock is newer and must not be deleted
+func (c *Client) deleteAbandonedLock(ctx context.Context, abandoned *Lock) error {
+	holder, err := c.getLock(ctx, abandoned.Parameter)
+	if err != nil {
+		return err
+	}
+	if holder == nil || holder.ID != abandoned.ID {
+		return nil
+	}
+	return c.deleteLock(ctx, abandoned.Parameter)
+}
+
+// deleteLock deletes the lock parameter, ignoring one that no longer exists
+func (c *Client) deleteLock(ctx context.Context, name string) error {
+	_, err := c.ssm.DeleteParameterWithContext(ctx, &ssm.DeleteParameterInput{
+		Name: aws.String(name),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeParameterNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+package deployer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testLockParameter = "/ecs-deploy/lock/prd/app"
+
+// heldLock returns the JSON of a lock owned by owner, acquired age ago
+func heldLock(t *testing.T, owner string, age time.Duration) string {
+	value, err := json.Marshal(&Lock{ID: "held", Owner: owner, Acquired: time.Now().Add(-age).UTC(), TTL: Duration(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(value)
+}
+
+func TestAcquireLock(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		wantLocked bool
+	}{
+		{name: "unlocked", parameters: map[string]string{}},
+		{name: "locked", parameters: map[string]string{testLockParameter: heldLock(t, "ci@runner", time.Minute)}, wantLocked: true},
+		{name: "abandoned", parameters: map[string]string{testLockParameter: heldLock(t, "ci@runner", 2*time.Hour)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeSSM := &fakeSSM{parameters: test.parameters}
+			client := newFakeClient(t, newFakeECS(), fakeSSM)
+
+			lock, err := client.AcquireLock(context.Background(), DeploymentOptions{Application: "app", Environment: "prd", LockOwner: "me@laptop"})
+			var locked *LockedError
+			if test.wantLocked {
+				if !errors.As(err, &locked) || locked.Holder.Owner != "ci@runner" {
+					t.Fatalf("AcquireLock() error = %v, want the service locked by ci@runner", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			holder, err := client.GetLock(context.Background(), DeploymentOptions{Application: "app", Environment: "prd"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if holder == nil || holder.ID != lock.ID || holder.Owner != "me@laptop" {
+				t.Fatalf("lock = %+v, want %+v", holder, lock)
+			}
+
+			err = client.ReleaseLock(context.Background(), lock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := fakeSSM.parameters[testLockParameter]; ok {
+				t.Error("the lock was not released")
+			}
+		})
+	}
+}
+
+func TestReleaseLockTakenOver(t *testing.T) {
+	fakeSSM := &fakeSSM{parameters: map[string]string{}}
+	client := newFakeClient(t, newFakeECS(), fakeSSM)
+
+	lock, err := client.AcquireLock(context.Background(), DeploymentOptions{Application: "app", Environment: "prd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another deployment took the lock over once it expired
+	fakeSSM.parameters[testLockParameter] = heldLock(t, "ci@runner", 0)
+
+	err = client.ReleaseLock(context.Background(), lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fakeSSM.parameters[testLockParameter]; !ok {
+		t.Error("the lock of the other deployment was released")
+	}
+}
+
+func TestPerformDeploymentReleaseLockFails(t *testing.T) {
+	fakeSSM := &fakeSSM{parameters: map[string]string{}, deleteErr: errors.New("throttled")}
+	client := newFakeClient(t, newFakeECS(), fakeSSM)
+
+	results, err := client.PerformDeployment(context.Background(), DeploymentOptions{Application: "app", Environment: "prd", Version: "1.2"})
+	if err == nil || !strings.Contains(err.Error(), "releasing lock "+testLockParameter+" failed: throttled") {
+		t.Fatalf("PerformDeployment() error = %v, want the lock release failure", err)
+	}
+	// The service was updated, so its results are returned with the error
+	if results == nil || results.TaskDefinition != testNewTaskDefinitionArn {
+		t.Errorf("results = %+v, want the service updated to %s", results, testNewTaskDefinitionArn)
+	}
+}
@@ -0,0 +1,277 @@
+package deployer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ManifestSchemaVersion is the manifest schemaVersion read by this release
+const ManifestSchemaVersion = 1
+
+// goTypeRegexp matches the Go type yaml errors end with
+var goTypeRegexp = regexp.MustCompile(` in type deployer\.\w+$`)
+
+// Manifest is a declarative deployment read from a YAML or JSON file such as ecs-deploy.yaml. The settings apply to
+// every environment; the overlay in Environments named after the environment being deployed is merged over them.
+type Manifest struct {
+	// SchemaVersion must be ManifestSchemaVersion
+	SchemaVersion int `yaml:"schemaVersion"`
+	ManifestSpec  `yaml:",inline"`
+	// Environments are overlays keyed by environment. Mappings are merged key by key; scalars and lists replace the base value
+	Environments map[string]ManifestSpec `yaml:"environments"`
+
+	// name of the file, prefixed to errors
+	name string
+	// root is the parsed document overlays are merged on, keeping the line of every value
+	root *yaml.Node
+}
+
+// ManifestSpec are the settings of a Manifest, or of one of its environment overlays
+type ManifestSpec struct {
+	// Application is the ECS service name
+	Application string `yaml:"application"`
+	// Services ships the same version to several ECS services instead of Application
+	Services []string `yaml:"services"`
+	// Regions deploys to the environment's cluster in each region
+	Regions []string `yaml:"regions"`
+	// Roles are IAM role ARNs to assume for a target, keyed by environment, region or environment@region
+	Roles map[string]string `yaml:"roles"`
+	// Waves are the targets deployed together, in order, each a comma separated list of regions or environment@region
+	Waves     []string `yaml:"waves"`
+	WavePause Duration `yaml:"wavePause"`
+	// Images maps container names to versions. A container without a version is set to the version being shipped
+	Images map[string]string `yaml:"images"`
+	// Env sets environment variables, keyed by container name then variable name
+	Env     map[string]map[string]string `yaml:"env"`
+	Secrets ManifestSecrets              `yaml:"secrets"`
+	// Cpu and Memory override the task size, e.g. 512 or "1 vCPU"
+	Cpu          string        `yaml:"cpu"`
+	Memory       string        `yaml:"memory"`
+	DesiredCount *int64        `yaml:"desiredCount"`
+	Wait         ManifestWait  `yaml:"wait"`
+	SmokeTests   []SmokeTest   `yaml:"smokeTests"`
+	Hooks        ManifestHooks `yaml:"hooks"`
+}
+
+// ManifestSecrets are the SSM Parameter Store paths container secrets are refreshed from
+type ManifestSecrets struct {
+	Prefixes []string `yaml:"prefixes"`
+	Refresh  bool     `yaml:"refresh"`
+}
+
+// ManifestWait sets how a deployment is waited on once it is invoked
+type ManifestWait struct {
+	MaxAttempts       int      `yaml:"maxAttempts"`
+	FailureThreshold  *int     `yaml:"failureThreshold"`
+	SkipTargetHealth  bool     `yaml:"skipTargetHealth"`
+	NoWait            bool     `yaml:"noWait"`
+	RollbackOnFailure bool     `yaml:"rollbackOnFailure"`
+	Bake              Duration `yaml:"bake"`
+	Alarms            []string `yaml:"alarms"`
+}
+
+// ManifestHooks are shell commands run around a deployment
+type ManifestHooks struct {
+	// PreDeploy runs before the new task definition is registered; a failing command aborts the deployment
+	PreDeploy []string `yaml:"preDeploy"`
+	// PostDeploy runs once the deployment succeeded
+	PostDeploy []string `yaml:"postDeploy"`
+	// OnFailure runs once the deployment failed
+	OnFailure []string `yaml:"onFailure"`
+}
+
+// LoadManifest reads and validates the manifest at path
+func LoadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseManifest(path, data)
+}
+
+// ParseManifest parses and validates a YAML or JSON manifest. Errors carry the line of the offending value.
+func ParseManifest(name string, data []byte) (*Manifest, error) {
+	manifest := &Manifest{name: name}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(manifest)
+	if err == io.EOF {
+		return nil, fmt.Errorf("%s: empty manifest", name)
+	}
+	if err != nil {
+		return nil, manifest.error(err)
+	}
+
+	manifest.root = &yaml.Node{}
+	err = yaml.Unmarshal(data, manifest.root)
+	if err != nil {
+		return nil, manifest.error(err)
+	}
+
+	value := mappingValue(manifest.root.Content[0], "schemaVersion")
+	if value == nil {
+		return nil, fmt.Errorf("%s: line 1: missing schemaVersion, expected %d", name, ManifestSchemaVersion)
+	}
+	if manifest.SchemaVersion != ManifestSchemaVersion {
+		return nil, fmt.Errorf("%s: line %d: unsupported schemaVersion %d, expected %d", name, value.Line, manifest.SchemaVersion, ManifestSchemaVersion)
+	}
+
+	return manifest, nil
+}
+
+// ForEnvironment returns the manifest's settings with the overlay of environment merged over them
+func (manifest *Manifest) ForEnvironment(environment string) (*ManifestSpec, error) {
+	document := manifest.root.Content[0]
+
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: document.Line, Column: document.Column}
+	var overlay *yaml.Node
+	for i := 0; i+1 < len(document.Content); i += 2 {
+		switch document.Content[i].Value {
+		case "schemaVersion":
+		case "environments":
+			overlay = mappingValue(document.Content[i+1], environment)
+		default:
+			merged.Content = append(merged.Content, document.Content[i], document.Content[i+1])
+		}
+	}
+	if overlay != nil {
+		merged = mergeNodes(merged, overlay)
+	}
+
+	spec := &ManifestSpec{}
+	err := merged.Decode(spec)
+	if err != nil {
+		return nil, manifest.error(err)
+	}
+	return spec, nil
+}
+
+// error prefixes a decoding error with the manifest name, listing every invalid value of a *yaml.TypeError
+func (manifest *Manifest) error(err error) error {
+	if typeError, ok := err.(*yaml.TypeError); ok {
+		var errs []string
+		for _, e := range typeError.Errors {
+			// "field x not found in type deployer.ManifestSpec" names Go types the manifest author never sees
+			errs = append(errs, goTypeRegexp.ReplaceAllString(e, ""))
+		}
+		return fmt.Errorf("%s: %s", manifest.name, strings.Join(errs, "; "))
+	}
+	return fmt.Errorf("%s: %s", manifest.name, strings.TrimPrefix(err.Error(), "yaml: "))
+}
+
+// mappingValue returns the value of key in a mapping node, or nil
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	if mapping == nil || mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// mergeNodes merges overlay over base without modifying either. Mappings are merged key by key; any other overlay value replaces base.
+func mergeNodes(base, overlay *yaml.Node) *yaml.Node {
+	if base.Kind != yaml.MappingNode || overlay.Kind != yaml.MappingNode {
+		return overlay
+	}
+
+	merged := *base
+	merged.Content = append([]*yaml.Node{}, base.Content...)
+	for i := 0; i+1 < len(overlay.Content); i += 2 {
+		key, value := overlay.Content[i], overlay.Content[i+1]
+
+		found := false
+		for j := 0; j+1 < len(merged.Content); j += 2 {
+			if merged.Content[j].Value == key.Value {
+				merged.Content[j+1] = mergeNodes(merged.Content[j+1], value)
+				found = true
+			}
+		}
+		if !found {
+			merged.Content = append(merged.Content, key, value)
+		}
+	}
+	return &merged
+}
+
+// manifestError reports an invalid value at its line. It is returned as a *yaml.TypeError so every invalid value is reported together.
+func manifestError(value *yaml.Node, format string, a ...interface{}) error {
+	return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: %s", value.Line, fmt.Sprintf(format, a...))}}
+}
+
+// UnmarshalYAML decodes a duration string such as "10m", or a number of seconds
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		if value.Tag == "!!int" || value.Tag == "!!float" {
+			seconds, err := strconv.ParseFloat(value.Value, 64)
+			if err == nil {
+				*d = Duration(time.Duration(seconds * float64(time.Second)))
+				return nil
+			}
+		}
+		duration, err := time.ParseDuration(value.Value)
+		if err == nil {
+			*d = Duration(duration)
+			return nil
+		}
+	}
+	return manifestError(value, "invalid duration %q", value.Value)
+}
+
+// UnmarshalYAML decodes a smoke test written like --smoke-test as URL[,status=200][,body=REGEXP][,timeout=10s],
+// or as a mapping of url, status, body and timeout
+func (smokeTest *SmokeTest) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		parsed, err := ParseSmokeTest(value.Value)
+		if err != nil {
+			return manifestError(value, "%v", err)
+		}
+		*smokeTest = parsed
+		return nil
+
+	case yaml.MappingNode:
+		// Decoding a node does not reject unknown fields, so they are checked here
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			switch key := value.Content[i]; key.Value {
+			case "url", "status", "body", "timeout":
+			default:
+				return manifestError(key, "unknown smoke test field %q, expected url, status, body or timeout", key.Value)
+			}
+		}
+
+		var fields struct {
+			URL     string   `yaml:"url"`
+			Status  int      `yaml:"status"`
+			Body    string   `yaml:"body"`
+			Timeout Duration `yaml:"timeout"`
+		}
+		err := value.Decode(&fields)
+		if err != nil {
+			return err
+		}
+
+		parsed := SmokeTest{URL: fields.URL, ExpectedStatus: fields.Status, BodyRegexp: fields.Body, Timeout: fields.Timeout}
+		if parsed.URL == "" {
+			return manifestError(value, "smoke test has no url")
+		}
+		if _, err := regexp.Compile(parsed.BodyRegexp); err != nil {
+			return manifestError(mappingValue(value, "body"), "invalid smoke test body regexp: %v", err)
+		}
+		*smokeTest = parsed
+		return nil
+	}
+	return manifestError(value, "invalid smoke test, expected a string or a mapping")
+}
@@ -0,0 +1,181 @@
+package deployer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+const testManifest = `schemaVersion: 1
+application: app
+regions: [us-east-1]
+images:
+  web: ""
+env:
+  web:
+    LOG_LEVEL: info
+    REGION: east
+desiredCount: 2
+wait:
+  bake: 10m
+  alarms: [app-5xx]
+hooks:
+  preDeploy: [make migrate]
+  onFailure: [./notify.sh failed]
+environments:
+  prd:
+    regions: [us-east-1, eu-west-1]
+    desiredCount: 6
+    env:
+      web:
+        LOG_LEVEL: warn
+`
+
+func TestParseManifestErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		wantErr  string
+	}{
+		{
+			name:     "unknown key",
+			manifest: "schemaVersion: 1\napplication: app\nreplicas: 2\n",
+			wantErr:  `ecs-deploy.yaml: line 3: field replicas not found`,
+		},
+		{
+			name:     "unknown overlay key",
+			manifest: "schemaVersion: 1\nenvironments:\n  prd:\n    replicas: 2\n",
+			wantErr:  `ecs-deploy.yaml: line 4: field replicas not found`,
+		},
+		{
+			name:     "missing schemaVersion",
+			manifest: "application: app\n",
+			wantErr:  `ecs-deploy.yaml: line 1: missing schemaVersion, expected 1`,
+		},
+		{
+			name:     "unsupported schemaVersion",
+			manifest: "application: app\nschemaVersion: 2\n",
+			wantErr:  `ecs-deploy.yaml: line 2: unsupported schemaVersion 2, expected 1`,
+		},
+		{
+			name:     "invalid duration",
+			manifest: "schemaVersion: 1\nwait:\n  bake: soon\n",
+			wantErr:  `ecs-deploy.yaml: line 3: invalid duration "soon"`,
+		},
+		{
+			name:     "unknown smoke test field",
+			manifest: "schemaVersion: 1\nsmokeTests:\n  - url: https://app.local/health\n    code: 200\n",
+			wantErr:  `ecs-deploy.yaml: line 4: unknown smoke test field "code", expected url, status, body or timeout`,
+		},
+		{
+			name:     "smoke test without url",
+			manifest: "schemaVersion: 1\nsmokeTests:\n  - status: 200\n",
+			wantErr:  `ecs-deploy.yaml: line 3: smoke test has no url`,
+		},
+		{
+			name:     "every invalid value",
+			manifest: "schemaVersion: 1\nwavePause: later\nwait:\n  bake: soon\n",
+			wantErr:  `ecs-deploy.yaml: line 2: invalid duration "later"; line 4: invalid duration "soon"`,
+		},
+		{
+			name:     "empty",
+			manifest: "",
+			wantErr:  `ecs-deploy.yaml: empty manifest`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseManifest("ecs-deploy.yaml", []byte(test.manifest))
+			if err == nil || !strings.HasPrefix(err.Error(), test.wantErr) {
+				t.Fatalf("ParseManifest() error = %v, want %s", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestManifestForEnvironment(t *testing.T) {
+	manifest, err := ParseManifest("ecs-deploy.yaml", []byte(testManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		environment string
+		want        ManifestSpec
+	}{
+		{
+			// The overlay replaces scalars and lists, and merges mappings key by key
+			environment: "prd",
+			want: ManifestSpec{
+				Application:  "app",
+				Regions:      []string{"us-east-1", "eu-west-1"},
+				Images:       map[string]string{"web": ""},
+				Env:          map[string]map[string]string{"web": {"LOG_LEVEL": "warn", "REGION": "east"}},
+				DesiredCount: aws.Int64(6),
+				Wait:         ManifestWait{Bake: Duration(10 * time.Minute), Alarms: []string{"app-5xx"}},
+				Hooks:        ManifestHooks{PreDeploy: []string{"make migrate"}, OnFailure: []string{"./notify.sh failed"}},
+			},
+		},
+		{
+			// An environment without an overlay gets the base settings
+			environment: "stg",
+			want: ManifestSpec{
+				Application:  "app",
+				Regions:      []string{"us-east-1"},
+				Images:       map[string]string{"web": ""},
+				Env:          map[string]map[string]string{"web": {"LOG_LEVEL": "info", "REGION": "east"}},
+				DesiredCount: aws.Int64(2),
+				Wait:         ManifestWait{Bake: Duration(10 * time.Minute), Alarms: []string{"app-5xx"}},
+				Hooks:        ManifestHooks{PreDeploy: []string{"make migrate"}, OnFailure: []string{"./notify.sh failed"}},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.environment, func(t *testing.T) {
+			spec, err := manifest.ForEnvironment(test.environment)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*spec, test.want) {
+				t.Errorf("ForEnvironment(%q) = %+v, want %+v", test.environment, *spec, test.want)
+			}
+		})
+	}
+
+	// Merging an overlay leaves the base settings of other environments untouched
+	spec, err := manifest.ForEnvironment("stg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := spec.Env["web"]["LOG_LEVEL"]; got != "info" {
+		t.Errorf("stg LOG_LEVEL = %s after merging prd, want info", got)
+	}
+}
+
+func TestManifestSmokeTests(t *testing.T) {
+	manifest, err := ParseManifest("ecs-deploy.json", []byte(`{
+  "schemaVersion": 1,
+  "smokeTests": [
+    "https://app.local/health,status=204,timeout=5s",
+    {"url": "https://app.local/", "body": "ok", "timeout": 2}
+  ]
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := manifest.ForEnvironment("prd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []SmokeTest{
+		{URL: "https://app.local/health", ExpectedStatus: 204, Timeout: Duration(5 * time.Second)},
+		{URL: "https://app.local/", BodyRegexp: "ok", Timeout: Duration(2 * time.Second)},
+	}
+	if !reflect.DeepEqual(spec.SmokeTests, want) {
+		t.Errorf("SmokeTests = %+v, want %+v", spec.SmokeTests, want)
+	}
+}
@@ -0,0 +1,514 @@
+package deployer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+
+	"github.com/mitchellh/copystructure"
+)
+
+// Plan describes the changes a deployment will make, without making them
+type Plan struct {
+	// Options the plan was built from
+	Options DeploymentOptions `json:"Options"`
+	// BaseTaskDefinition is the task definition currently used by the service
+	BaseTaskDefinition *ecs.TaskDefinition `json:"BaseTaskDefinition"`
+	// TaskDefinition is the new task definition revision that will be registered
+	TaskDefinition *ecs.RegisterTaskDefinitionInput `json:"TaskDefinition"`
+	// Changes lists the task level field changes, excluding container definitions
+	Changes []FieldChange `json:"Changes,omitempty"`
+	// Containers lists the changes to each container definition that has any
+	Containers []ContainerChanges `json:"Containers"`
+	// ServiceChanges lists the service level field changes, such as the deployment circuit breaker
+	ServiceChanges []FieldChange `json:"ServiceChanges,omitempty"`
+	// ServiceUpdate is the service update that will run. TaskDefinition is set once the new revision is registered
+	ServiceUpdate *ecs.UpdateServiceInput `json:"ServiceUpdate"`
+	// CodeDeploy is set for services using the CODE_DEPLOY deployment controller, which are shipped through a CodeDeploy deployment instead of ServiceUpdate
+	CodeDeploy *CodeDeployTarget `json:"CodeDeploy,omitempty"`
+	// Canary is set for services using the EXTERNAL deployment controller, which are shipped as a new task set instead of ServiceUpdate
+	Canary *CanaryTarget `json:"Canary,omitempty"`
+	// VersionParameter is the SSM parameter holding the desired version. Empty with NoVersionParameter
+	VersionParameter string `json:"VersionParameter,omitempty"`
+	// PreviousVersion is the desired version in SSM Parameter Store before the deployment, nil when it was not set
+	PreviousVersion *string `json:"PreviousVersion"`
+}
+
+// ContainerChanges are the changes to a single container definition
+type ContainerChanges struct {
+	Name           string         `json:"Name"`
+	Changes        []FieldChange  `json:"Changes,omitempty"`
+	SecretsAdded   []SecretChange `json:"SecretsAdded,omitempty"`
+	SecretsRemoved []SecretChange `json:"SecretsRemoved,omitempty"`
+	SecretsChanged []SecretChange `json:"SecretsChanged,omitempty"`
+	// SecretsUnchanged is only populated with FullDiff
+	SecretsUnchanged []SecretChange `json:"SecretsUnchanged,omitempty"`
+}
+
+// FieldChange is a task or container definition field, keyed by its path, e.g. PortMappings[8080].HostPort.
+// Old is empty for added fields and New is empty for removed fields. Unchanged fields are only included with FullDiff.
+type FieldChange struct {
+	Field string `json:"Field"`
+	Old   string `json:"Old"`
+	New   string `json:"New"`
+}
+
+// Changed reports whether the field differs
+func (fc FieldChange) Changed() bool {
+	return fc.Old != fc.New
+}
+
+// SecretChange is an added, removed or changed container secret. Old is empty for added secrets and New is empty for removed secrets
+type SecretChange struct {
+	Name string `json:"Name"`
+	Old  string `json:"Old,omitempty"`
+	New  string `json:"New,omitempty"`
+}
+
+// HasChanges reports whether the container definition changes at all
+func (cc ContainerChanges) HasChanges() bool {
+	for _, fc := range cc.Changes {
+		if fc.Changed() {
+			return true
+		}
+	}
+	return len(cc.SecretsAdded)+len(cc.SecretsRemoved)+len(cc.SecretsChanged) > 0
+}
+
+// String renders the plan as a human readable diff
+func (plan *Plan) String() string {
+	var sb strings.Builder
+	if len(plan.Changes) > 0 {
+		diff := NewDiff("task_definition", aws.StringValue(plan.TaskDefinition.Family))
+		for _, fc := range plan.Changes {
+			diff.AddChange(fc.Field, fc.Old, fc.New)
+		}
+		sb.WriteString(diff.String())
+	}
+	if len(plan.ServiceChanges) > 0 {
+		diff := NewDiff("service", plan.Options.Application)
+		for _, fc := range plan.ServiceChanges {
+			diff.AddChange(fc.Field, fc.Old, fc.New)
+		}
+		sb.WriteString(diff.String())
+	}
+	for _, cc := range plan.Containers {
+		diff := NewDiff("container", cc.Name)
+		for _, fc := range cc.Changes {
+			diff.AddChange(fc.Field, fc.Old, fc.New)
+		}
+		for _, sc := range cc.SecretsUnchanged {
+			diff.AddChange(sc.Name, sc.Old, sc.New)
+		}
+		for _, sc := range cc.SecretsChanged {
+			diff.AddChange(sc.Name, sc.Old, sc.New)
+		}
+		for _, sc := range cc.SecretsRemoved {
+			diff.AddChange(sc.Name, sc.Old, "")
+		}
+		for _, sc := range cc.SecretsAdded {
+			diff.AddChange(sc.Name, "", sc.New)
+		}
+		sb.WriteString(diff.String())
+	}
+	return sb.String()
+}
+
+// PlanDeployment builds the Plan for a deployment by
+//
+//	bumping the image version in task definition
+//	setting ContainerEnvironment variables and the Cpu, Memory and DesiredCount overrides
+//	refreshing secrets from SSM Parameter Store when RefreshSecrets is set
+//	diffing the current and desired container definitions
+func (c *Client) PlanDeployment(ctx context.Context, depOpts DeploymentOptions) (*Plan, error) {
+	// Get the ECS Service
+	service, err := c.describeService(ctx, depOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Blue/green services are deployed by CodeDeploy, which owns their deployment configuration
+	var codeDeployTarget *CodeDeployTarget
+	if isCodeDeployService(service) {
+		if depOpts.CircuitBreaker != nil || depOpts.CircuitBreakerRollback != nil || depOpts.DeploymentAlarms != nil || depOpts.DeploymentAlarmsRollback != nil {
+			return nil, fmt.Errorf("service %s uses CodeDeploy: the circuit breaker and deployment alarms are not supported, configure them on the deployment group", depOpts.Application)
+		}
+		codeDeployTarget, err = newCodeDeployTarget(service, depOpts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Services with an external deployment controller are shipped as a new task set
+	var canaryTarget *CanaryTarget
+	if isExternalService(service) {
+		if depOpts.CircuitBreaker != nil || depOpts.CircuitBreakerRollback != nil || depOpts.DeploymentAlarms != nil || depOpts.DeploymentAlarmsRollback != nil {
+			return nil, fmt.Errorf("service %s uses an external deployment controller: the circuit breaker and deployment alarms are not supported", depOpts.Application)
+		}
+		canaryTarget, err = newCanaryTarget(service, depOpts)
+		if err != nil {
+			return nil, err
+		}
+	} else if depOpts.Canary > 0 {
+		return nil, fmt.Errorf("service %s does not use the EXTERNAL deployment controller required for canary releases", depOpts.Application)
+	}
+	if depOpts.DesiredCount != nil && (codeDeployTarget != nil || canaryTarget != nil) {
+		return nil, fmt.Errorf("service %s does not use the ECS deployment controller: changing the desired count is not supported", depOpts.Application)
+	}
+
+	// Fail before changing anything when an alarm to bake against does not exist
+	_, err = c.describeAlarms(ctx, depOpts.BakeAlarms)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the full task definition the service runs
+	baseTaskDefinition, err := runningTaskDefinition(service)
+	if err != nil {
+		return nil, err
+	}
+	dtdi := &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: aws.String(baseTaskDefinition),
+	}
+	dtdo, err := c.ecs.DescribeTaskDefinitionWithContext(ctx, dtdi)
+	if err != nil {
+		return nil, err
+	}
+
+	// Deep copy to preserve original container definitions for diff
+	desiredContainerDefinitions, err := copyContainerDefinitions(dtdo.TaskDefinition.ContainerDefinitions)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bump the image version of the targeted containers
+	err = setContainerImageVersions(depOpts, desiredContainerDefinitions)
+	if err != nil {
+		return nil, err
+	}
+
+	err = setContainerEnvironment(depOpts, desiredContainerDefinitions)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fail fast when a new image does not exist, rather than waiting on a rollout that can never stabilize
+	if !depOpts.SkipImageCheck {
+		err = c.verifyImagesExist(ctx, dtdo.TaskDefinition.ContainerDefinitions, desiredContainerDefinitions)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tags, err := c.getTaskDefinitionTags(ctx, dtdo.TaskDefinition.TaskDefinitionArn)
+	if err != nil {
+		return nil, err
+	}
+	rtdi := NewRegisterTaskDefinitionInput(dtdo.TaskDefinition, tags)
+	rtdi.ContainerDefinitions = desiredContainerDefinitions
+	if depOpts.Cpu != "" {
+		rtdi.Cpu = aws.String(depOpts.Cpu)
+	}
+	if depOpts.Memory != "" {
+		rtdi.Memory = aws.String(depOpts.Memory)
+	}
+
+	if depOpts.RefreshSecrets {
+
+		for _, dcd := range desiredContainerDefinitions {
+			// Clear all existing secrets
+			dcd.Secrets = []*ecs.Secret{}
+		}
+
+		for _, secretsPrefix := range depOpts.SecretsPrefix {
+
+			globalSecrets, err := c.getEcsSecretsBySSMPath(ctx, secretsPrefix)
+			if err != nil {
+				return nil, fmt.Errorf("error refreshing ssm params: %v", err)
+			}
+
+			for _, dcd := range desiredContainerDefinitions {
+				// Deep copy ecs.secrets, so items in each list are separate and distict memory addresses
+				copyGlobalSecrets, err := copystructure.Copy(globalSecrets)
+				if err != nil {
+					return nil, fmt.Errorf("error performing deep copy of secrets: %v", err)
+				}
+				newGlobalSecrets, ok := copyGlobalSecrets.([]*ecs.Secret)
+				if !ok {
+					return nil, fmt.Errorf("error converting interface to ecs.Secret")
+				}
+
+				// Get container specific secrets
+				containerSpecificSecrets, err := c.getEcsSecretsBySSMPath(ctx, fmt.Sprintf("%s/%s", secretsPrefix, *dcd.Name))
+				if err != nil {
+					return nil, fmt.Errorf("error getting container secret by ssm path: %v", err)
+				}
+
+				// Add Secrets to container
+				dcd.Secrets = append(dcd.Secrets, newGlobalSecrets...)
+				dcd.Secrets = append(dcd.Secrets, containerSpecificSecrets...)
+			}
+		}
+	}
+
+	plan := &Plan{
+		Options:            depOpts,
+		BaseTaskDefinition: dtdo.TaskDefinition,
+		TaskDefinition:     rtdi,
+		CodeDeploy:         codeDeployTarget,
+		Canary:             canaryTarget,
+	}
+
+	// Record the current desired version so a failed deployment can restore it
+	if !depOpts.NoVersionParameter {
+		plan.VersionParameter, err = versionParameterName(depOpts)
+		if err != nil {
+			return nil, err
+		}
+		plan.PreviousVersion, err = c.getDesiredVersion(ctx, depOpts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = plan.diff(NewRegisterTaskDefinitionInput(dtdo.TaskDefinition, tags), depOpts.FullDiff)
+	if err != nil {
+		return nil, err
+	}
+
+	deploymentConfiguration, err := desiredDeploymentConfiguration(service.DeploymentConfiguration, depOpts)
+	if err != nil {
+		return nil, err
+	}
+	desiredCount := service.DesiredCount
+	if depOpts.DesiredCount != nil {
+		desiredCount = depOpts.DesiredCount
+	}
+	// Only the service fields ship changes are diffed
+	type serviceFields struct {
+		DeploymentConfiguration *ecs.DeploymentConfiguration
+		DesiredCount            *int64
+	}
+	plan.ServiceChanges, err = diffFields(serviceFields{service.DeploymentConfiguration, service.DesiredCount}, serviceFields{deploymentConfiguration, desiredCount}, depOpts.FullDiff)
+	if err != nil {
+		return nil, err
+	}
+
+	// Update the service with the new task definition
+	plan.ServiceUpdate = &ecs.UpdateServiceInput{
+		Cluster:                 service.ClusterArn,
+		DeploymentConfiguration: deploymentConfiguration,
+		DesiredCount:            desiredCount,
+		ForceNewDeployment:      aws.Bool(true),
+		NetworkConfiguration:    service.NetworkConfiguration,
+		PlatformVersion:         service.PlatformVersion,
+		Service:                 service.ServiceArn,
+	}
+	// If HealthCheckGracePeriodSeconds == 0 (Default), assume that the previous definition did not include a health check.
+	if service.HealthCheckGracePeriodSeconds != nil && *service.HealthCheckGracePeriodSeconds != 0 {
+		plan.ServiceUpdate.HealthCheckGracePeriodSeconds = service.HealthCheckGracePeriodSeconds
+	}
+
+	return plan, nil
+}
+
+// ApplyPlan executes a Plan by
+//
+//	registering the new task definition
+//	updating the ECS service to use it, or creating a CodeDeploy deployment of it for CODE_DEPLOY services,
+//	or creating a canary task set of it for EXTERNAL services, which is promoted with PromoteCanary
+//	setting desired version in SSM Parameter Store /<env>/<app>/VERSION, unless SetVersionAfterStable is set
+//
+// The version parameter is only written once the service update is accepted, so a failed deployment never moves it.
+// When writing it fails, the service has already been updated: the results are returned along with the error.
+func (c *Client) ApplyPlan(ctx context.Context, plan *Plan) (*DeploymentResults, error) {
+	deploymentResults := &DeploymentResults{Plan: plan}
+
+	rtdo, err := c.ecs.RegisterTaskDefinitionWithContext(ctx, plan.TaskDefinition)
+	if err != nil {
+		return nil, err
+	}
+
+	plan.ServiceUpdate.TaskDefinition = rtdo.TaskDefinition.TaskDefinitionArn
+	if plan.CodeDeploy != nil {
+		description := fmt.Sprintf("ecs-deploy: %s %s", plan.Options.Application, plan.Options.Version)
+		plan.CodeDeploy.DeploymentID, err = c.createCodeDeployDeployment(ctx, plan.CodeDeploy, *rtdo.TaskDefinition.TaskDefinitionArn, description)
+		if err != nil {
+			return nil, err
+		}
+		deploymentResults.SuccessfullyInvoked = true
+		deploymentResults.ClusterArn = aws.StringValue(plan.ServiceUpdate.Cluster)
+		deploymentResults.ServiceArn = aws.StringValue(plan.ServiceUpdate.Service)
+		deploymentResults.ServiceName = plan.Options.Application
+		deploymentResults.TaskDefinition = aws.StringValue(rtdo.TaskDefinition.TaskDefinitionArn)
+		deploymentResults.CodeDeployDeploymentID = plan.CodeDeploy.DeploymentID
+	} else if plan.Canary != nil {
+		err = c.createCanaryTaskSet(ctx, plan.Canary, rtdo.TaskDefinition.TaskDefinitionArn)
+		if err != nil {
+			return nil, err
+		}
+		deploymentResults.SuccessfullyInvoked = true
+		deploymentResults.ClusterArn = aws.StringValue(plan.ServiceUpdate.Cluster)
+		deploymentResults.ServiceArn = aws.StringValue(plan.ServiceUpdate.Service)
+		deploymentResults.ServiceName = plan.Options.Application
+		deploymentResults.TaskDefinition = aws.StringValue(rtdo.TaskDefinition.TaskDefinitionArn)
+		deploymentResults.TaskSet = plan.Canary.TaskSet
+	} else {
+		uso, err := c.ecs.UpdateServiceWithContext(ctx, plan.ServiceUpdate)
+		if err != nil {
+			return nil, err
+		}
+		deploymentResults.SetService(uso.Service)
+	}
+
+	// Set the desired application version
+	if !plan.Options.SetVersionAfterStable {
+		err = c.PublishVersion(ctx, plan)
+		if err != nil {
+			return deploymentResults, fmt.Errorf("service %s updated to %s but setting the version parameter failed: %v", deploymentResults.ServiceName, deploymentResults.TaskDefinition, err)
+		}
+	}
+
+	return deploymentResults, nil
+}
+
+// StalePlanError is returned when a saved plan no longer matches the service it was made for
+type StalePlanError struct {
+	Service string
+	// Planned is the task definition, or primary task set, the plan was made against
+	Planned string
+	// Current is the service's task definition, or primary task set, now
+	Current string
+}
+
+func (e *StalePlanError) Error() string {
+	return fmt.Sprintf("plan for %s is stale: it was made against %s but the service now runs %s", e.Service, e.Planned, e.Current)
+}
+
+// CheckPlan verifies a plan made earlier, e.g. saved to a file, can still be applied as made. The service must still run
+// the plan's base task definition, and EXTERNAL services the same primary task set, otherwise a *StalePlanError is
+// returned. Unless the plan sets DesiredCount, the service's current desired count is carried over so any scaling since
+// the plan was made is kept.
+func (c *Client) CheckPlan(ctx context.Context, plan *Plan) error {
+	service, err := c.describeService(ctx, plan.Options)
+	if err != nil {
+		return err
+	}
+
+	current, err := runningTaskDefinition(service)
+	if err != nil {
+		return err
+	}
+	planned := aws.StringValue(plan.BaseTaskDefinition.TaskDefinitionArn)
+	if current != planned {
+		return &StalePlanError{Service: plan.Options.Application, Planned: planned, Current: current}
+	}
+	if plan.Canary != nil {
+		current := ""
+		if primary := primaryTaskSet(service); primary != nil {
+			current = aws.StringValue(primary.TaskSetArn)
+		}
+		if current != plan.Canary.PrimaryTaskSet {
+			return &StalePlanError{Service: plan.Options.Application, Planned: plan.Canary.PrimaryTaskSet, Current: current}
+		}
+	}
+
+	if plan.Options.DesiredCount == nil {
+		plan.ServiceUpdate.DesiredCount = service.DesiredCount
+	}
+	return nil
+}
+
+// diff records the task and container level changes from base to the plan's task definition
+func (plan *Plan) diff(base *ecs.RegisterTaskDefinitionInput, full bool) error {
+	// Container definitions are diffed individually, matched by name
+	baseTask, desiredTask := *base, *plan.TaskDefinition
+	baseTask.ContainerDefinitions, desiredTask.ContainerDefinitions = nil, nil
+
+	changes, err := diffFields(baseTask, desiredTask, full)
+	if err != nil {
+		return err
+	}
+	plan.Changes = changes
+
+	names := []string{}
+	for _, cd := range plan.TaskDefinition.ContainerDefinitions {
+		names = append(names, aws.StringValue(cd.Name))
+	}
+	for _, cd := range base.ContainerDefinitions {
+		if findContainerDefinition(plan.TaskDefinition.ContainerDefinitions, aws.StringValue(cd.Name)) == nil {
+			names = append(names, aws.StringValue(cd.Name))
+		}
+	}
+
+	for _, name := range names {
+		current := findContainerDefinition(base.ContainerDefinitions, name)
+		if current == nil {
+			current = &ecs.ContainerDefinition{Name: aws.String(name)}
+		}
+		desired := findContainerDefinition(plan.TaskDefinition.ContainerDefinitions, name)
+		if desired == nil {
+			desired = &ecs.ContainerDefinition{Name: aws.String(name)}
+		}
+
+		cc, err := diffContainerDefinitions(current, desired, full)
+		if err != nil {
+			return err
+		}
+		if full || cc.HasChanges() {
+			plan.Containers = append(plan.Containers, cc)
+		}
+	}
+
+	return nil
+}
+
+// diffContainerDefinitions records the field and secret changes between two container definitions
+func diffContainerDefinitions(current, desired *ecs.ContainerDefinition, full bool) (ContainerChanges, error) {
+	cc := ContainerChanges{Name: aws.StringValue(current.Name)}
+
+	// Secrets are reported separately as added, removed and changed
+	currentFields, desiredFields := *current, *desired
+	currentFields.Secrets, desiredFields.Secrets = nil, nil
+
+	changes, err := diffFields(currentFields, desiredFields, full)
+	if err != nil {
+		return cc, err
+	}
+	cc.Changes = changes
+
+	for _, x := range current.Secrets {
+		found := false
+		for _, y := range desired.Secrets {
+			if *x.Name == *y.Name {
+				found = true
+				if *x.ValueFrom != *y.ValueFrom {
+					cc.SecretsChanged = append(cc.SecretsChanged, SecretChange{Name: *x.Name, Old: *x.ValueFrom, New: *y.ValueFrom})
+				} else if full {
+					cc.SecretsUnchanged = append(cc.SecretsUnchanged, SecretChange{Name: *x.Name, Old: *x.ValueFrom, New: *y.ValueFrom})
+				}
+			}
+		}
+
+		if !found {
+			cc.SecretsRemoved = append(cc.SecretsRemoved, SecretChange{Name: *x.Name, Old: *x.ValueFrom})
+		}
+	}
+
+	for _, y := range desired.Secrets {
+		found := false
+		for _, x := range current.Secrets {
+			if *x.Name == *y.Name {
+				found = true
+			}
+		}
+		if !found {
+			cc.SecretsAdded = append(cc.SecretsAdded, SecretChange{Name: *y.Name, New: *y.ValueFrom})
+		}
+	}
+
+	return cc, nil
+}
@@ -0,0 +1,177 @@
+package deployer
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestPlanDeployment(t *testing.T) {
+	fakeECS := newFakeECS()
+	fakeSSM := &fakeSSM{parameters: map[string]string{"/prd/app/VERSION": "1.1"}}
+	client := newFakeClient(t, fakeECS, fakeSSM)
+
+	plan, err := client.PlanDeployment(context.Background(), DeploymentOptions{
+		Application:          "app",
+		Environment:          "prd",
+		Version:              "1.2",
+		ContainerEnvironment: map[string]map[string]string{"web": {"LOG_LEVEL": "debug", "FEATURE": "on"}},
+		Cpu:                  "512",
+		DesiredCount:         aws.Int64(4),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := aws.StringValue(plan.TaskDefinition.ContainerDefinitions[0].Image); got != "registry.local:5000/team/app:1.2" {
+		t.Errorf("web image = %s, want registry.local:5000/team/app:1.2", got)
+	}
+	if got := aws.StringValue(fakeECS.taskDefinition.ContainerDefinitions[0].Image); got != "registry.local:5000/team/app:1.1" {
+		t.Errorf("planning changed the base task definition's web image to %s", got)
+	}
+	if plan.VersionParameter != "/prd/app/VERSION" || aws.StringValue(plan.PreviousVersion) != "1.1" {
+		t.Errorf("version parameter = %s, previous version = %v, want /prd/app/VERSION and 1.1", plan.VersionParameter, aws.StringValue(plan.PreviousVersion))
+	}
+
+	wantChanges := []FieldChange{{Field: "Cpu", Old: "256", New: "512"}}
+	if !reflect.DeepEqual(plan.Changes, wantChanges) {
+		t.Errorf("Changes = %+v, want %+v", plan.Changes, wantChanges)
+	}
+	wantServiceChanges := []FieldChange{{Field: "DesiredCount", Old: "2", New: "4"}}
+	if !reflect.DeepEqual(plan.ServiceChanges, wantServiceChanges) {
+		t.Errorf("ServiceChanges = %+v, want %+v", plan.ServiceChanges, wantServiceChanges)
+	}
+	// The worker container is unchanged, so only web is diffed
+	wantContainers := []ContainerChanges{{
+		Name: "web",
+		Changes: []FieldChange{
+			{Field: "Environment[FEATURE].Name", Old: "", New: "FEATURE"},
+			{Field: "Environment[FEATURE].Value", Old: "", New: "on"},
+			{Field: "Environment[LOG_LEVEL].Value", Old: "info", New: "debug"},
+			{Field: "Image", Old: "registry.local:5000/team/app:1.1", New: "registry.local:5000/team/app:1.2"},
+		},
+	}}
+	if !reflect.DeepEqual(plan.Containers, wantContainers) {
+		t.Errorf("Containers = %+v, want %+v", plan.Containers, wantContainers)
+	}
+
+	if got := aws.Int64Value(plan.ServiceUpdate.DesiredCount); got != 4 {
+		t.Errorf("ServiceUpdate.DesiredCount = %d, want 4", got)
+	}
+	if fakeECS.registered != nil || fakeECS.updated != nil || fakeSSM.parameters["/prd/app/VERSION"] != "1.1" {
+		t.Error("planning changed the service, task definition or version parameter")
+	}
+}
+
+func TestPlanDeploymentFullDiff(t *testing.T) {
+	client := newFakeClient(t, newFakeECS(), &fakeSSM{parameters: map[string]string{}})
+
+	plan, err := client.PlanDeployment(context.Background(), DeploymentOptions{Application: "app", Environment: "prd", Version: "1.2", FullDiff: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.PreviousVersion != nil {
+		t.Errorf("PreviousVersion = %s, want nil for a parameter that does not exist", aws.StringValue(plan.PreviousVersion))
+	}
+	// With FullDiff unchanged containers and fields are included too
+	if len(plan.Containers) != 2 || plan.Containers[1].Name != "worker" {
+		t.Fatalf("Containers = %+v, want web and worker", plan.Containers)
+	}
+	for _, fc := range plan.Containers[1].Changes {
+		if fc.Changed() {
+			t.Errorf("worker field %s changed from %s to %s", fc.Field, fc.Old, fc.New)
+		}
+	}
+}
+
+func TestPlanDeploymentMissingService(t *testing.T) {
+	client := newFakeClient(t, newFakeECS(), &fakeSSM{parameters: map[string]string{}})
+
+	_, err := client.PlanDeployment(context.Background(), DeploymentOptions{Application: "missing", Environment: "prd", Version: "1.2"})
+	if err == nil {
+		t.Fatal("PlanDeployment() of a missing service succeeded")
+	}
+}
+
+func TestApplyPlan(t *testing.T) {
+	tests := []struct {
+		name                  string
+		setVersionAfterStable bool
+		putErr                error
+		wantVersion           string
+		wantErr               bool
+	}{
+		{name: "writes the version", wantVersion: "1.2"},
+		{name: "version after stable", setVersionAfterStable: true, wantVersion: "1.1"},
+		{name: "version write fails", putErr: errors.New("throttled"), wantVersion: "1.1", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeECS := newFakeECS()
+			fakeSSM := &fakeSSM{parameters: map[string]string{"/prd/app/VERSION": "1.1"}}
+			client := newFakeClient(t, fakeECS, fakeSSM)
+
+			plan, err := client.PlanDeployment(context.Background(), DeploymentOptions{
+				Application:           "app",
+				Environment:           "prd",
+				Version:               "1.2",
+				SetVersionAfterStable: test.setVersionAfterStable,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			fakeSSM.putErr = test.putErr
+
+			results, err := client.ApplyPlan(context.Background(), plan)
+			if test.wantErr != (err != nil) {
+				t.Fatalf("ApplyPlan() error = %v, want error %v", err, test.wantErr)
+			}
+
+			// The service is updated, and reported as such, even when the version write fails
+			if fakeECS.registered != plan.TaskDefinition {
+				t.Error("the planned task definition was not registered")
+			}
+			if fakeECS.updated == nil || aws.StringValue(fakeECS.updated.TaskDefinition) != testNewTaskDefinitionArn {
+				t.Fatalf("service update = %+v, want the new task definition %s", fakeECS.updated, testNewTaskDefinitionArn)
+			}
+			if results == nil || !results.SuccessfullyInvoked || results.TaskDefinition != testNewTaskDefinitionArn {
+				t.Fatalf("results = %+v, want the service updated to %s", results, testNewTaskDefinitionArn)
+			}
+			if got := fakeSSM.parameters["/prd/app/VERSION"]; got != test.wantVersion {
+				t.Errorf("version parameter = %s, want %s", got, test.wantVersion)
+			}
+		})
+	}
+}
+
+func TestRevertVersionTemplate(t *testing.T) {
+	// A template rendering the version names a parameter per release, which must be restored as it was planned
+	fakeSSM := &fakeSSM{parameters: map[string]string{"/prd/app/1.2": "1.1"}}
+	client := newFakeClient(t, newFakeECS(), fakeSSM)
+
+	plan, err := client.PlanDeployment(context.Background(), DeploymentOptions{
+		Application:      "app",
+		Environment:      "prd",
+		Version:          "1.2",
+		VersionParameter: "/{{.Environment}}/{{.Application}}/{{.Version}}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.PublishVersion(context.Background(), plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.RevertVersion(context.Background(), plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"/prd/app/1.2": "1.1"}
+	if !reflect.DeepEqual(fakeSSM.parameters, want) {
+		t.Errorf("parameters = %v, want %v", fakeSSM.parameters, want)
+	}
+}
@@ -0,0 +1,214 @@
+package deployer
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// PerformRollback points an ECS service back at a previous task definition by
+//
+//	locating the revision registered before the currently running one (or the pinned TaskDefinitionRevision)
+//	updating the ECS service to use that revision
+//	restoring the SSM version parameter to the image version of that revision's Container, or its first container
+//
+// When the service was updated but restoring the version parameter failed, the results are returned along with the error.
+func (c *Client) PerformRollback(ctx context.Context, depOpts DeploymentOptions) (*DeploymentResults, error) {
+	deploymentResults := &DeploymentResults{}
+
+	// Get the ECS Service
+	service, err := c.describeService(ctx, depOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Services with an external deployment controller run their task definitions on task sets
+	if isExternalService(service) {
+		return nil, fmt.Errorf("service %s uses an external deployment controller: ship the previous version instead", depOpts.Application)
+	}
+	if aws.StringValue(service.TaskDefinition) == "" {
+		return nil, fmt.Errorf("service %s has no task definition to roll back from", depOpts.Application)
+	}
+
+	family, revision, err := parseTaskDefinitionArn(aws.StringValue(service.TaskDefinition))
+	if err != nil {
+		return nil, err
+	}
+
+	var target string
+	if depOpts.TaskDefinitionRevision > 0 {
+		if depOpts.TaskDefinitionRevision == revision {
+			return nil, fmt.Errorf("service %s is already running %s:%d", depOpts.Application, family, revision)
+		}
+		target = fmt.Sprintf("%s:%d", family, depOpts.TaskDefinitionRevision)
+	} else {
+		target, err = c.previousTaskDefinition(ctx, family, revision)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Get the full task definition we are rolling back to
+	dtdo, err := c.ecs.DescribeTaskDefinitionWithContext(ctx, &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: aws.String(target),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if isCodeDeployService(service) {
+		target, err := newCodeDeployTarget(service, depOpts)
+		if err != nil {
+			return nil, err
+		}
+		description := fmt.Sprintf("ecs-deploy: roll back %s to %s", depOpts.Application, aws.StringValue(dtdo.TaskDefinition.TaskDefinitionArn))
+		deploymentResults.CodeDeployDeploymentID, err = c.createCodeDeployDeployment(ctx, target, aws.StringValue(dtdo.TaskDefinition.TaskDefinitionArn), description)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		_, err = c.ecs.UpdateServiceWithContext(ctx, &ecs.UpdateServiceInput{
+			Cluster:            service.ClusterArn,
+			Service:            service.ServiceArn,
+			TaskDefinition:     dtdo.TaskDefinition.TaskDefinitionArn,
+			ForceNewDeployment: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	deploymentResults.SetService(service)
+	deploymentResults.TaskDefinition = aws.StringValue(dtdo.TaskDefinition.TaskDefinitionArn)
+
+	// Restore the desired application version to match the rolled back image. The service has already been updated,
+	// so a failure is returned along with the results.
+	if !depOpts.NoVersionParameter && len(dtdo.TaskDefinition.ContainerDefinitions) > 0 {
+		cd := dtdo.TaskDefinition.ContainerDefinitions[0]
+		if depOpts.Container != "" {
+			cd = findContainerDefinition(dtdo.TaskDefinition.ContainerDefinitions, depOpts.Container)
+			if cd == nil {
+				return deploymentResults, fmt.Errorf("service %s rolled back to %s but container %s was not found to restore the version parameter", depOpts.Application, deploymentResults.TaskDefinition, depOpts.Container)
+			}
+		}
+		ref, err := ParseImageReference(aws.StringValue(cd.Image))
+		if err != nil {
+			return deploymentResults, fmt.Errorf("service %s rolled back to %s but restoring the version parameter failed: %v", depOpts.Application, deploymentResults.TaskDefinition, err)
+		}
+		if version := ref.Version(); version != "" {
+			depOpts.Version = version
+			var name string
+			name, err = versionParameterName(depOpts)
+			if err == nil {
+				err = c.putVersionParameter(ctx, name, version, depOpts.Description)
+			}
+			if err != nil {
+				return deploymentResults, fmt.Errorf("service %s rolled back to %s but restoring the version parameter failed: %v", depOpts.Application, deploymentResults.TaskDefinition, err)
+			}
+		}
+	}
+
+	return deploymentResults, nil
+}
+
+// RollbackPlan reverts an applied Plan by
+//
+//	updating the ECS service back to the plan's BaseTaskDefinition, or rolling back its CodeDeploy deployment or canary task set
+//	restoring the SSM version parameter to the plan's PreviousVersion
+//
+// When only restoring the version parameter fails, the results of the rollback are returned along with the error.
+func (c *Client) RollbackPlan(ctx context.Context, plan *Plan) (*DeploymentResults, error) {
+	deploymentResults := &DeploymentResults{Plan: plan}
+
+	if plan.CodeDeploy != nil {
+		id, err := c.rollbackCodeDeployDeployment(ctx, plan.Options, plan.CodeDeploy, aws.StringValue(plan.BaseTaskDefinition.TaskDefinitionArn))
+		if err != nil {
+			return nil, err
+		}
+		deploymentResults.SuccessfullyInvoked = true
+		deploymentResults.ClusterArn = aws.StringValue(plan.ServiceUpdate.Cluster)
+		deploymentResults.ServiceArn = aws.StringValue(plan.ServiceUpdate.Service)
+		deploymentResults.ServiceName = plan.Options.Application
+		deploymentResults.TaskDefinition = aws.StringValue(plan.BaseTaskDefinition.TaskDefinitionArn)
+		deploymentResults.CodeDeployDeploymentID = id
+	} else if plan.Canary != nil {
+		err := c.rollbackCanary(ctx, plan.Canary)
+		if err != nil {
+			return nil, err
+		}
+		deploymentResults.SuccessfullyInvoked = true
+		deploymentResults.ClusterArn = aws.StringValue(plan.ServiceUpdate.Cluster)
+		deploymentResults.ServiceArn = aws.StringValue(plan.ServiceUpdate.Service)
+		deploymentResults.ServiceName = plan.Options.Application
+		deploymentResults.TaskDefinition = aws.StringValue(plan.BaseTaskDefinition.TaskDefinitionArn)
+		deploymentResults.TaskSet = plan.Canary.PrimaryTaskSet
+	} else {
+		uso, err := c.ecs.UpdateServiceWithContext(ctx, &ecs.UpdateServiceInput{
+			Cluster:            plan.ServiceUpdate.Cluster,
+			Service:            plan.ServiceUpdate.Service,
+			TaskDefinition:     plan.BaseTaskDefinition.TaskDefinitionArn,
+			ForceNewDeployment: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, err
+		}
+		deploymentResults.SetService(uso.Service)
+	}
+
+	// The service is already rolled back, so its results are returned with the error
+	err := c.RevertVersion(ctx, plan)
+	if err != nil {
+		return deploymentResults, fmt.Errorf("service %s rolled back to %s but restoring the version parameter failed: %v", plan.Options.Application, aws.StringValue(plan.BaseTaskDefinition.TaskDefinitionArn), err)
+	}
+
+	return deploymentResults, nil
+}
+
+// previousTaskDefinition returns the ARN of the newest active revision of family older than revision
+func (c *Client) previousTaskDefinition(ctx context.Context, family string, revision int64) (arn string, err error) {
+	err = c.ecs.ListTaskDefinitionsPagesWithContext(ctx, &ecs.ListTaskDefinitionsInput{
+		FamilyPrefix: aws.String(family),
+		Sort:         aws.String(ecs.SortOrderDesc),
+	},
+		func(page *ecs.ListTaskDefinitionsOutput, lastPage bool) bool {
+			for _, v := range page.TaskDefinitionArns {
+				// FamilyPrefix also matches longer family names, e.g. "app" matches "app-worker"
+				f, r, perr := parseTaskDefinitionArn(*v)
+				if perr != nil || f != family {
+					continue
+				}
+				if r < revision {
+					arn = *v
+					return false
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return arn, err
+	}
+
+	if arn == "" {
+		return arn, fmt.Errorf("no active task definition revision of %s found before %d", family, revision)
+	}
+	return arn, nil
+}
+
+// parseTaskDefinitionArn splits a task definition ARN (or family:revision) into its family and revision
+func parseTaskDefinitionArn(arn string) (family string, revision int64, err error) {
+	name := arn[strings.LastIndex(arn, "/")+1:]
+	i := strings.LastIndex(name, ":")
+	if i == -1 {
+		return family, revision, fmt.Errorf("unable to parse task definition revision from %s", arn)
+	}
+
+	revision, err = strconv.ParseInt(name[i+1:], 10, 64)
+	if err != nil {
+		return family, revision, fmt.Errorf("unable to parse task definition revision from %s: %v", arn, err)
+	}
+	return name[:i], revision, nil
+}
@@ -0,0 +1,52 @@
+package deployer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestPerformRollbackExternalService(t *testing.T) {
+	fakeECS := newFakeECS()
+	// EXTERNAL services run their task definitions on task sets, not on the service
+	fakeECS.service.DeploymentController = &ecs.DeploymentController{Type: aws.String(ecs.DeploymentControllerTypeExternal)}
+	fakeECS.service.TaskDefinition = nil
+	client := newFakeClient(t, fakeECS, &fakeSSM{parameters: map[string]string{}})
+
+	_, err := client.PerformRollback(context.Background(), DeploymentOptions{Application: "app", Environment: "prd"})
+	if err == nil || !strings.Contains(err.Error(), "ship the previous version instead") {
+		t.Fatalf("PerformRollback() error = %v, want the external deployment controller refused", err)
+	}
+}
+
+func TestRollbackPlanVersionFails(t *testing.T) {
+	fakeECS := newFakeECS()
+	fakeSSM := &fakeSSM{parameters: map[string]string{"/prd/app/VERSION": "1.1"}}
+	client := newFakeClient(t, fakeECS, fakeSSM)
+
+	plan, err := client.PlanDeployment(context.Background(), DeploymentOptions{Application: "app", Environment: "prd", Version: "1.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.ApplyPlan(context.Background(), plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeSSM.putErr = errors.New("throttled")
+
+	// The service is rolled back, and reported as such, even when restoring the version fails
+	results, err := client.RollbackPlan(context.Background(), plan)
+	if err == nil {
+		t.Fatal("RollbackPlan() succeeded although the version parameter was not restored")
+	}
+	if results == nil || results.TaskDefinition != testTaskDefinitionArn {
+		t.Fatalf("results = %+v, want the service rolled back to %s", results, testTaskDefinitionArn)
+	}
+	if got := aws.StringValue(fakeECS.updated.TaskDefinition); got != testTaskDefinitionArn {
+		t.Errorf("service task definition = %s, want %s", got, testTaskDefinitionArn)
+	}
+}
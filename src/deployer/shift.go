@@ -0,0 +1,301 @@
+package deployer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+)
+
+const (
+	// defaultShiftPause is used when DeploymentOptions.ShiftPause is not set
+	defaultShiftPause = time.Minute
+)
+
+// defaultShiftSteps are the percentages of traffic shifted to the idle service when DeploymentOptions.ShiftSteps is not set
+var defaultShiftSteps = []int64{10, 50, 100}
+
+// ShiftTarget is a pair of ECS services behind one listener rule whose weighted target groups split traffic between them
+type ShiftTarget struct {
+	// ListenerRule is the ARN of the rule forwarding to both services' target groups
+	ListenerRule string `json:"ListenerRule"`
+	// Live is the service receiving traffic before the shift
+	Live            string `json:"Live"`
+	LiveTargetGroup string `json:"LiveTargetGroup"`
+	// Idle is the service the new version is shipped to before traffic is shifted to it
+	Idle            string `json:"Idle"`
+	IdleTargetGroup string `json:"IdleTargetGroup"`
+	// LiveWeight and IdleWeight are the rule's weights before the shift, restored by RestoreTraffic
+	LiveWeight int64 `json:"LiveWeight"`
+	IdleWeight int64 `json:"IdleWeight"`
+	// Shifted is the percentage of traffic shifted to Idle so far
+	Shifted int64 `json:"Shifted"`
+}
+
+// ShiftServices returns the services traffic is shifted between: ShiftServices, or <Application>-blue and <Application>-green
+func ShiftServices(depOpts DeploymentOptions) []string {
+	if len(depOpts.ShiftServices) > 0 {
+		return depOpts.ShiftServices
+	}
+	return []string{depOpts.Application + "-blue", depOpts.Application + "-green"}
+}
+
+// PlanShift locates the paired services of a traffic shift, their target groups and the listener rule splitting traffic
+// between them. The service with the lower weight is idle and receives the new version.
+func (c *Client) PlanShift(ctx context.Context, depOpts DeploymentOptions) (*ShiftTarget, error) {
+	services := ShiftServices(depOpts)
+	if len(services) != 2 {
+		return nil, fmt.Errorf("traffic shifting requires exactly two services, got %d", len(services))
+	}
+
+	var targetGroups []string
+	for _, name := range services {
+		opts := depOpts
+		opts.Application = name
+		service, err := c.describeService(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		if len(service.LoadBalancers) == 0 || service.LoadBalancers[0].TargetGroupArn == nil {
+			return nil, fmt.Errorf("service %s has no load balancer target group", name)
+		}
+		targetGroups = append(targetGroups, aws.StringValue(service.LoadBalancers[0].TargetGroupArn))
+	}
+
+	rule := depOpts.ShiftListenerRule
+	if rule == "" {
+		var err error
+		rule, err = c.findListenerRule(ctx, targetGroups[0], targetGroups[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	weights, err := c.ruleWeights(ctx, rule)
+	if err != nil {
+		return nil, err
+	}
+	for _, tg := range targetGroups {
+		if _, ok := weights[tg]; !ok {
+			return nil, fmt.Errorf("listener rule %s does not forward to target group %s", rule, tg)
+		}
+	}
+
+	live, idle := 0, 1
+	switch {
+	case weights[targetGroups[0]] < weights[targetGroups[1]]:
+		live, idle = 1, 0
+	case weights[targetGroups[0]] == weights[targetGroups[1]]:
+		return nil, fmt.Errorf("listener rule %s splits traffic evenly between %s and %s; neither is idle", rule, services[0], services[1])
+	}
+
+	return &ShiftTarget{
+		ListenerRule:    rule,
+		Live:            services[live],
+		LiveTargetGroup: targetGroups[live],
+		Idle:            services[idle],
+		IdleTargetGroup: targetGroups[idle],
+		LiveWeight:      weights[targetGroups[live]],
+		IdleWeight:      weights[targetGroups[idle]],
+	}, nil
+}
+
+// IdleOptions returns depOpts targeting the idle service. The version parameter is resolved against depOpts first so
+// both services share the application's parameter.
+func (target *ShiftTarget) IdleOptions(depOpts DeploymentOptions) (DeploymentOptions, error) {
+	if !depOpts.NoVersionParameter {
+		name, err := versionParameterName(depOpts)
+		if err != nil {
+			return depOpts, err
+		}
+		depOpts.VersionParameter = name
+	}
+	depOpts.Application = target.Idle
+	return depOpts, nil
+}
+
+// ShiftTraffic steps the listener rule's weights towards the idle service through ShiftSteps. After each step it pauses
+// for ShiftPause, then requires every target of the idle service to be healthy and every BakeAlarms alarm to be out of
+// ALARM. On failure the weights are left as they are; call RestoreTraffic to return traffic to the live service.
+func (c *Client) ShiftTraffic(ctx context.Context, depOpts DeploymentOptions, target *ShiftTarget) error {
+	steps := depOpts.ShiftSteps
+	if len(steps) == 0 {
+		steps = defaultShiftSteps
+	}
+	pause := time.Duration(depOpts.ShiftPause)
+	if pause <= 0 {
+		pause = defaultShiftPause
+	}
+
+	previous := int64(0)
+	for _, step := range steps {
+		if step <= previous || step > 100 {
+			return fmt.Errorf("invalid shift steps %v: must increase and be at most 100", steps)
+		}
+		previous = step
+	}
+
+	for _, step := range steps {
+		err := c.setRuleWeights(ctx, target.ListenerRule, map[string]int64{
+			target.LiveTargetGroup: 100 - step,
+			target.IdleTargetGroup: step,
+		})
+		if err != nil {
+			return err
+		}
+		target.Shifted = step
+		fmt.Fprintf(c.out, "%s  shifted %d%% of traffic to %s\n", time.Now().Format(time.Kitchen), step, target.Idle)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pause):
+		}
+
+		err = c.checkTargetHealth(ctx, target.IdleTargetGroup)
+		if err != nil {
+			return err
+		}
+
+		err = c.checkAlarms(ctx, depOpts.BakeAlarms)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "  %s targets healthy; alarms OK\n", target.Idle)
+	}
+	return nil
+}
+
+// RestoreTraffic returns the listener rule to the weights it had before the shift
+func (c *Client) RestoreTraffic(ctx context.Context, target *ShiftTarget) error {
+	err := c.setRuleWeights(ctx, target.ListenerRule, map[string]int64{
+		target.LiveTargetGroup: target.LiveWeight,
+		target.IdleTargetGroup: target.IdleWeight,
+	})
+	if err != nil {
+		return err
+	}
+	target.Shifted = 0
+	fmt.Fprintf(c.out, "Restored traffic to %s\n", target.Live)
+	return nil
+}
+
+// findListenerRule returns the ARN of the listener rule forwarding to both target groups
+func (c *Client) findListenerRule(ctx context.Context, targetGroupA, targetGroupB string) (string, error) {
+	dtgo, err := c.elbv2.DescribeTargetGroupsWithContext(ctx, &elbv2.DescribeTargetGroupsInput{
+		TargetGroupArns: aws.StringSlice([]string{targetGroupA}),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for _, tg := range dtgo.TargetGroups {
+		for _, lb := range tg.LoadBalancerArns {
+			var listeners []*elbv2.Listener
+			err = c.elbv2.DescribeListenersPagesWithContext(ctx, &elbv2.DescribeListenersInput{
+				LoadBalancerArn: lb,
+			}, func(page *elbv2.DescribeListenersOutput, lastPage bool) bool {
+				listeners = append(listeners, page.Listeners...)
+				return true
+			})
+			if err != nil {
+				return "", err
+			}
+
+			for _, listener := range listeners {
+				rules, err := c.describeRules(ctx, &elbv2.DescribeRulesInput{ListenerArn: listener.ListenerArn})
+				if err != nil {
+					return "", err
+				}
+				for _, rule := range rules {
+					weights := forwardWeights(rule)
+					_, a := weights[targetGroupA]
+					_, b := weights[targetGroupB]
+					if a && b {
+						return aws.StringValue(rule.RuleArn), nil
+					}
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("no listener rule forwards to both %s and %s", targetGroupA, targetGroupB)
+}
+
+// describeRules returns every rule matching input
+func (c *Client) describeRules(ctx context.Context, input *elbv2.DescribeRulesInput) ([]*elbv2.Rule, error) {
+	var rules []*elbv2.Rule
+	for {
+		dro, err := c.elbv2.DescribeRulesWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, dro.Rules...)
+		if dro.NextMarker == nil {
+			return rules, nil
+		}
+		input.Marker = dro.NextMarker
+	}
+}
+
+// ruleWeights returns the weight of every target group the listener rule forwards to
+func (c *Client) ruleWeights(ctx context.Context, ruleArn string) (map[string]int64, error) {
+	rules, err := c.describeRules(ctx, &elbv2.DescribeRulesInput{RuleArns: aws.StringSlice([]string{ruleArn})})
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("listener rule %s not found", ruleArn)
+	}
+	return forwardWeights(rules[0]), nil
+}
+
+// setRuleWeights updates the weights of the listener rule's forward action, leaving its other actions unchanged
+func (c *Client) setRuleWeights(ctx context.Context, ruleArn string, weights map[string]int64) error {
+	rules, err := c.describeRules(ctx, &elbv2.DescribeRulesInput{RuleArns: aws.StringSlice([]string{ruleArn})})
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return fmt.Errorf("listener rule %s not found", ruleArn)
+	}
+
+	actions := rules[0].Actions
+	for _, action := range actions {
+		if aws.StringValue(action.Type) != elbv2.ActionTypeEnumForward || action.ForwardConfig == nil {
+			continue
+		}
+		// A weighted forward action is described by its ForwardConfig alone
+		action.TargetGroupArn = nil
+		for _, tuple := range action.ForwardConfig.TargetGroups {
+			if weight, ok := weights[aws.StringValue(tuple.TargetGroupArn)]; ok {
+				tuple.Weight = aws.Int64(weight)
+			}
+		}
+	}
+
+	_, err = c.elbv2.ModifyRuleWithContext(ctx, &elbv2.ModifyRuleInput{
+		RuleArn: aws.String(ruleArn),
+		Actions: actions,
+	})
+	return err
+}
+
+// forwardWeights returns the weight of every target group forwarded to by the rule's forward actions
+func forwardWeights(rule *elbv2.Rule) map[string]int64 {
+	weights := map[string]int64{}
+	for _, action := range rule.Actions {
+		if aws.StringValue(action.Type) != elbv2.ActionTypeEnumForward {
+			continue
+		}
+		if action.ForwardConfig != nil {
+			for _, tuple := range action.ForwardConfig.TargetGroups {
+				weights[aws.StringValue(tuple.TargetGroupArn)] = aws.Int64Value(tuple.Weight)
+			}
+		} else if action.TargetGroupArn != nil {
+			weights[aws.StringValue(action.TargetGroupArn)] = 1
+		}
+	}
+	return weights
+}
@@ -0,0 +1,181 @@
+package deployer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultSmokeTestTimeout is used when SmokeTest.Timeout is not set
+	defaultSmokeTestTimeout = 10 * time.Second
+	// maxSmokeTestBody is how much of a response body is matched against SmokeTest.BodyRegexp
+	maxSmokeTestBody = 1 << 20
+)
+
+// SmokeTest is an HTTP GET run once the service is stable. The deployment fails unless it responds as expected.
+type SmokeTest struct {
+	URL string `json:"URL"`
+	// ExpectedStatus is the response status code required. Default: 200
+	ExpectedStatus int `json:"ExpectedStatus"`
+	// BodyRegexp must match the response body when set
+	BodyRegexp string `json:"BodyRegexp"`
+	// Timeout of the request. Default: 10s
+	Timeout Duration `json:"Timeout"`
+}
+
+// SmokeTestResult is the outcome of a SmokeTest
+type SmokeTestResult struct {
+	URL      string `json:"URL"`
+	Status   int    `json:"Status,omitempty"`
+	Duration string `json:"Duration"`
+	Passed   bool   `json:"Passed"`
+	Error    string `json:"Error,omitempty"`
+}
+
+// SmokeTestError is returned when any smoke test fails
+type SmokeTestError struct {
+	Results []SmokeTestResult
+}
+
+func (e *SmokeTestError) Error() string {
+	var reasons []string
+	for _, result := range e.Results {
+		if !result.Passed {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", result.URL, result.Error))
+		}
+	}
+	return fmt.Sprintf("smoke tests failed: %s", strings.Join(reasons, "; "))
+}
+
+// ParseSmokeTest parses a smoke test written as URL[,status=200][,body=REGEXP][,timeout=10s]
+func ParseSmokeTest(s string) (SmokeTest, error) {
+	parts := strings.Split(s, ",")
+	smokeTest := SmokeTest{URL: parts[0]}
+
+	// Commas that do not start a known option belong to the URL or body before them
+	last := &smokeTest.URL
+	for _, part := range parts[1:] {
+		key, value := part, ""
+		if i := strings.Index(part, "="); i >= 0 {
+			key, value = part[:i], part[i+1:]
+		}
+
+		switch key {
+		case "status":
+			status, err := strconv.Atoi(value)
+			if err != nil {
+				return smokeTest, fmt.Errorf("invalid smoke test status %q", value)
+			}
+			smokeTest.ExpectedStatus = status
+		case "body":
+			smokeTest.BodyRegexp = value
+			last = &smokeTest.BodyRegexp
+			continue
+		case "timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil {
+				return smokeTest, fmt.Errorf("invalid smoke test timeout %q", value)
+			}
+			smokeTest.Timeout = Duration(timeout)
+		default:
+			*last += "," + part
+			continue
+		}
+		last = &smokeTest.URL
+	}
+
+	if smokeTest.URL == "" {
+		return smokeTest, fmt.Errorf("smoke test %q has no URL", s)
+	}
+	if _, err := regexp.Compile(smokeTest.BodyRegexp); err != nil {
+		return smokeTest, fmt.Errorf("invalid smoke test body regexp: %v", err)
+	}
+	return smokeTest, nil
+}
+
+// RunSmokeTests runs every SmokeTests check, returning the result of each and a *SmokeTestError if any failed
+func (c *Client) RunSmokeTests(ctx context.Context, depOpts DeploymentOptions) ([]SmokeTestResult, error) {
+	var results []SmokeTestResult
+	failed := false
+	for _, smokeTest := range depOpts.SmokeTests {
+		result := c.runSmokeTest(ctx, smokeTest)
+		if result.Passed {
+			fmt.Fprintf(c.out, "  smoke test %s passed in %s\n", result.URL, result.Duration)
+		} else {
+			failed = true
+			fmt.Fprintf(c.out, "  smoke test %s failed: %s\n", result.URL, result.Error)
+		}
+		results = append(results, result)
+	}
+
+	if failed {
+		return results, &SmokeTestError{Results: results}
+	}
+	return results, nil
+}
+
+// runSmokeTest requests the smoke test's URL and checks the response
+func (c *Client) runSmokeTest(ctx context.Context, smokeTest SmokeTest) (result SmokeTestResult) {
+	result.URL = smokeTest.URL
+
+	timeout := time.Duration(smokeTest.Timeout)
+	if timeout <= 0 {
+		timeout = defaultSmokeTestTimeout
+	}
+	expectedStatus := smokeTest.ExpectedStatus
+	if expectedStatus == 0 {
+		expectedStatus = http.StatusOK
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start).Round(time.Millisecond).String()
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, smokeTest.URL, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+
+	result.Status = resp.StatusCode
+	if resp.StatusCode != expectedStatus {
+		result.Error = fmt.Sprintf("expected status %d, got %d", expectedStatus, resp.StatusCode)
+		return result
+	}
+
+	if smokeTest.BodyRegexp != "" {
+		re, err := regexp.Compile(smokeTest.BodyRegexp)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxSmokeTestBody))
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		if !re.Match(body) {
+			result.Error = fmt.Sprintf("body does not match %q", smokeTest.BodyRegexp)
+			return result
+		}
+	}
+
+	result.Passed = true
+	return result
+}
@@ -0,0 +1,106 @@
+package deployer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSmokeTest(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    SmokeTest
+		wantErr bool
+	}{
+		{in: "https://app.example.com/health", want: SmokeTest{URL: "https://app.example.com/health"}},
+		{in: "https://app.example.com/health,status=204,timeout=2s", want: SmokeTest{URL: "https://app.example.com/health", ExpectedStatus: 204, Timeout: Duration(2 * time.Second)}},
+		{in: "https://app.example.com/health?a=1,b=2", want: SmokeTest{URL: "https://app.example.com/health?a=1,b=2"}},
+		{in: "https://app.example.com/health?a=1,b=2,status=200", want: SmokeTest{URL: "https://app.example.com/health?a=1,b=2", ExpectedStatus: 200}},
+		{in: "https://app.example.com/health,body=a,b", want: SmokeTest{URL: "https://app.example.com/health", BodyRegexp: "a,b"}},
+		{in: "https://app.example.com/health,body=a,b,timeout=1s", want: SmokeTest{URL: "https://app.example.com/health", BodyRegexp: "a,b", Timeout: Duration(time.Second)}},
+		{in: `https://app.example.com/health,body="status":"ok"`, want: SmokeTest{URL: "https://app.example.com/health", BodyRegexp: `"status":"ok"`}},
+
+		{in: "", wantErr: true},
+		{in: ",status=200", wantErr: true},
+		{in: "https://app.example.com/health,status=ok", wantErr: true},
+		{in: "https://app.example.com/health,timeout=soon", wantErr: true},
+		{in: "https://app.example.com/health,body=(", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			got, err := ParseSmokeTest(test.in)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("ParseSmokeTest(%q) = %+v, want an error", test.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseSmokeTest(%q): %v", test.in, err)
+			}
+			if got != test.want {
+				t.Fatalf("ParseSmokeTest(%q) = %+v, want %+v", test.in, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRunSmokeTests(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"status":"ok"}`)
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := newFakeClient(t, newFakeECS(), &fakeSSM{parameters: map[string]string{}}, WithHTTPClient(server.Client()))
+
+	tests := []struct {
+		name      string
+		smokeTest SmokeTest
+		wantError string
+	}{
+		{name: "passes", smokeTest: SmokeTest{URL: server.URL + "/ok", BodyRegexp: `"status":"ok"`}},
+		{name: "expected status", smokeTest: SmokeTest{URL: server.URL + "/missing", ExpectedStatus: http.StatusNotFound}},
+		{name: "status mismatch", smokeTest: SmokeTest{URL: server.URL + "/missing"}, wantError: "expected status 200, got 404"},
+		{name: "body mismatch", smokeTest: SmokeTest{URL: server.URL + "/ok", BodyRegexp: `"status":"degraded"`}, wantError: "body does not match"},
+		{name: "timeout", smokeTest: SmokeTest{URL: server.URL + "/slow", Timeout: Duration(50 * time.Millisecond)}, wantError: "context deadline exceeded"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			results, err := client.RunSmokeTests(context.Background(), DeploymentOptions{SmokeTests: []SmokeTest{test.smokeTest}})
+			if len(results) != 1 {
+				t.Fatalf("got %d results, want 1", len(results))
+			}
+			result := results[0]
+
+			if test.wantError == "" {
+				if err != nil || !result.Passed {
+					t.Fatalf("RunSmokeTests() = %+v, %v, want a pass", result, err)
+				}
+				return
+			}
+			var smokeTestError *SmokeTestError
+			if !errors.As(err, &smokeTestError) {
+				t.Fatalf("RunSmokeTests() error = %v, want a *SmokeTestError", err)
+			}
+			if result.Passed || !strings.Contains(result.Error, test.wantError) {
+				t.Fatalf("RunSmokeTests() = %+v, want a failure containing %q", result, test.wantError)
+			}
+		})
+	}
+}
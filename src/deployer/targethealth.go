@@ -0,0 +1,258 @@
+package deployer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+)
+
+// targetStateUnregistered is reported for a task that is not yet registered with its target group
+const targetStateUnregistered = "unregistered"
+
+// TargetHealth is the health of a load balancer target
+type TargetHealth struct {
+	// Target is the target's id and port, e.g. 10.0.1.12:8080
+	Target      string `json:"Target"`
+	State       string `json:"State"`
+	Reason      string `json:"Reason,omitempty"`
+	Description string `json:"Description,omitempty"`
+}
+
+// UnhealthyTargetsError is returned when targets of a target group are not healthy
+type UnhealthyTargetsError struct {
+	TargetGroup string
+	Targets     []TargetHealth
+}
+
+func (e *UnhealthyTargetsError) Error() string {
+	if len(e.Targets) == 0 {
+		return fmt.Sprintf("target group %s has no registered targets", targetGroupName(e.TargetGroup))
+	}
+	var reasons []string
+	for _, target := range e.Targets {
+		reason := fmt.Sprintf("%s %s", target.Target, target.State)
+		if target.Description != "" {
+			reason += ": " + target.Description
+		}
+		reasons = append(reasons, reason)
+	}
+	return fmt.Sprintf("unhealthy targets in %s: %s", targetGroupName(e.TargetGroup), strings.Join(reasons, "; "))
+}
+
+// checkTargetHealth returns an *UnhealthyTargetsError unless the target group has targets and all of them are healthy
+func (c *Client) checkTargetHealth(ctx context.Context, targetGroup string) error {
+	targets, err := c.describeTargetHealth(ctx, targetGroup)
+	if err != nil {
+		return err
+	}
+
+	unhealthy := &UnhealthyTargetsError{TargetGroup: targetGroup}
+	for _, target := range targets {
+		if target.State != elbv2.TargetHealthStateEnumHealthy {
+			unhealthy.Targets = append(unhealthy.Targets, target)
+		}
+	}
+	if len(targets) == 0 || len(unhealthy.Targets) > 0 {
+		return unhealthy
+	}
+	return nil
+}
+
+// checkDeploymentTargetHealth returns an *UnhealthyTargetsError unless every running task of the deployment is
+// registered and healthy in each of the service's target groups
+func (c *Client) checkDeploymentTargetHealth(ctx context.Context, service *ecs.Service, deploymentID string) error {
+	expected, running, err := c.deploymentTargets(ctx, service, deploymentID)
+	if err != nil {
+		return err
+	}
+
+	for _, lb := range service.LoadBalancers {
+		targetGroup := aws.StringValue(lb.TargetGroupArn)
+		if targetGroup == "" || running == 0 {
+			continue
+		}
+		// Passing a target group none of the tasks register with would report a deployment nothing checked as healthy
+		if len(expected[targetGroup]) == 0 {
+			return fmt.Errorf("none of the %d running tasks of the deployment map to target group %s: no container %s exposes port %d", running, targetGroupName(targetGroup), aws.StringValue(lb.ContainerName), aws.Int64Value(lb.ContainerPort))
+		}
+
+		targets, err := c.describeTargetHealth(ctx, targetGroup)
+		if err != nil {
+			return err
+		}
+		health := map[string]TargetHealth{}
+		for _, target := range targets {
+			health[target.Target] = target
+		}
+
+		unhealthy := &UnhealthyTargetsError{TargetGroup: targetGroup}
+		for _, target := range expected[targetGroup] {
+			th, ok := health[target]
+			if !ok {
+				th = TargetHealth{Target: target, State: targetStateUnregistered}
+			}
+			if th.State != elbv2.TargetHealthStateEnumHealthy {
+				unhealthy.Targets = append(unhealthy.Targets, th)
+			}
+		}
+		if len(unhealthy.Targets) > 0 {
+			return unhealthy
+		}
+	}
+	return nil
+}
+
+// deploymentTargets returns the load balancer targets the running tasks of a deployment register as, keyed by target
+// group, and the number of running tasks. Tasks using awsvpc networking register their IP and container port; others
+// their EC2 instance and host port.
+func (c *Client) deploymentTargets(ctx context.Context, service *ecs.Service, deploymentID string) (map[string][]string, int, error) {
+	var taskArns []*string
+	err := c.ecs.ListTasksPagesWithContext(ctx, &ecs.ListTasksInput{
+		Cluster:       service.ClusterArn,
+		ServiceName:   service.ServiceName,
+		DesiredStatus: aws.String(ecs.DesiredStatusRunning),
+	}, func(page *ecs.ListTasksOutput, lastPage bool) bool {
+		taskArns = append(taskArns, page.TaskArns...)
+		return true
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var tasks []*ecs.Task
+	for len(taskArns) > 0 {
+		// DescribeTasks accepts up to 100 tasks
+		n := len(taskArns)
+		if n > 100 {
+			n = 100
+		}
+		dto, err := c.ecs.DescribeTasksWithContext(ctx, &ecs.DescribeTasksInput{
+			Cluster: service.ClusterArn,
+			Tasks:   taskArns[:n],
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, task := range dto.Tasks {
+			// Services start tasks as "ecs-svc/<deployment id>"
+			if aws.StringValue(task.StartedBy) == deploymentID {
+				tasks = append(tasks, task)
+			}
+		}
+		taskArns = taskArns[n:]
+	}
+
+	instances, err := c.containerInstances(ctx, service.ClusterArn, tasks)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	targets := map[string][]string{}
+	for _, lb := range service.LoadBalancers {
+		targetGroup := aws.StringValue(lb.TargetGroupArn)
+		if targetGroup == "" {
+			continue
+		}
+		for _, task := range tasks {
+			if ip := taskPrivateIP(task); ip != "" {
+				targets[targetGroup] = append(targets[targetGroup], fmt.Sprintf("%s:%d", ip, aws.Int64Value(lb.ContainerPort)))
+				continue
+			}
+			for _, container := range task.Containers {
+				if aws.StringValue(container.Name) != aws.StringValue(lb.ContainerName) {
+					continue
+				}
+				for _, binding := range container.NetworkBindings {
+					if aws.Int64Value(binding.ContainerPort) == aws.Int64Value(lb.ContainerPort) {
+						instance := instances[aws.StringValue(task.ContainerInstanceArn)]
+						targets[targetGroup] = append(targets[targetGroup], fmt.Sprintf("%s:%d", instance, aws.Int64Value(binding.HostPort)))
+					}
+				}
+			}
+		}
+	}
+	return targets, len(tasks), nil
+}
+
+// containerInstances maps the container instance ARNs of tasks to their EC2 instance ids
+func (c *Client) containerInstances(ctx context.Context, cluster *string, tasks []*ecs.Task) (map[string]string, error) {
+	var arns []*string
+	seen := map[string]bool{}
+	for _, task := range tasks {
+		arn := aws.StringValue(task.ContainerInstanceArn)
+		if arn == "" || seen[arn] {
+			continue
+		}
+		seen[arn] = true
+		arns = append(arns, task.ContainerInstanceArn)
+	}
+
+	instances := map[string]string{}
+	if len(arns) == 0 {
+		return instances, nil
+	}
+
+	dcio, err := c.ecs.DescribeContainerInstancesWithContext(ctx, &ecs.DescribeContainerInstancesInput{
+		Cluster:            cluster,
+		ContainerInstances: arns,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, ci := range dcio.ContainerInstances {
+		instances[aws.StringValue(ci.ContainerInstanceArn)] = aws.StringValue(ci.Ec2InstanceId)
+	}
+	return instances, nil
+}
+
+// taskPrivateIP returns the private IP of the task's elastic network interface, if it uses awsvpc networking
+func taskPrivateIP(task *ecs.Task) string {
+	for _, attachment := range task.Attachments {
+		if aws.StringValue(attachment.Type) != "ElasticNetworkInterface" {
+			continue
+		}
+		for _, detail := range attachment.Details {
+			if aws.StringValue(detail.Name) == "privateIPv4Address" {
+				return aws.StringValue(detail.Value)
+			}
+		}
+	}
+	return ""
+}
+
+// describeTargetHealth returns the health of every target registered with the target group
+func (c *Client) describeTargetHealth(ctx context.Context, targetGroup string) ([]TargetHealth, error) {
+	dtho, err := c.elbv2.DescribeTargetHealthWithContext(ctx, &elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(targetGroup),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []TargetHealth
+	for _, thd := range dtho.TargetHealthDescriptions {
+		target := TargetHealth{
+			Target: fmt.Sprintf("%s:%d", aws.StringValue(thd.Target.Id), aws.Int64Value(thd.Target.Port)),
+		}
+		if thd.TargetHealth != nil {
+			target.State = aws.StringValue(thd.TargetHealth.State)
+			target.Reason = aws.StringValue(thd.TargetHealth.Reason)
+			target.Description = aws.StringValue(thd.TargetHealth.Description)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// targetGroupName returns the name of a target group from its ARN, e.g. myapp from arn:...:targetgroup/myapp/73e2d6bc24d8a067
+func targetGroupName(arn string) string {
+	parts := strings.Split(arn, "/")
+	if len(parts) < 2 {
+		return arn
+	}
+	return parts[1]
+}
@@ -0,0 +1,54 @@
+package deployer
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// NewRegisterTaskDefinitionInput converts a described task definition into the input that registers an
+// identical new revision. Every field accepted by RegisterTaskDefinition is carried over; read-only fields
+// (Revision, Status, Compatibilities, RequiresAttributes, RegisteredAt/By, DeregisteredAt) are dropped.
+// Tags reserved by AWS ("aws:" prefix) are dropped because they cannot be set by callers.
+func NewRegisterTaskDefinitionInput(td *ecs.TaskDefinition, tags []*ecs.Tag) *ecs.RegisterTaskDefinitionInput {
+	rtdi := &ecs.RegisterTaskDefinitionInput{
+		ContainerDefinitions:    td.ContainerDefinitions,
+		Cpu:                     td.Cpu,
+		EphemeralStorage:        td.EphemeralStorage,
+		ExecutionRoleArn:        td.ExecutionRoleArn,
+		Family:                  td.Family,
+		InferenceAccelerators:   td.InferenceAccelerators,
+		IpcMode:                 td.IpcMode,
+		Memory:                  td.Memory,
+		NetworkMode:             td.NetworkMode,
+		PidMode:                 td.PidMode,
+		PlacementConstraints:    td.PlacementConstraints,
+		ProxyConfiguration:      td.ProxyConfiguration,
+		RequiresCompatibilities: td.RequiresCompatibilities,
+		RuntimePlatform:         td.RuntimePlatform,
+		TaskRoleArn:             td.TaskRoleArn,
+		Volumes:                 td.Volumes,
+	}
+
+	for _, tag := range tags {
+		if strings.HasPrefix(aws.StringValue(tag.Key), "aws:") {
+			continue
+		}
+		rtdi.Tags = append(rtdi.Tags, tag)
+	}
+
+	return rtdi
+}
+
+// getTaskDefinitionTags returns the tags on a task definition revision
+func (c *Client) getTaskDefinitionTags(ctx context.Context, taskDefinitionArn *string) ([]*ecs.Tag, error) {
+	tagsOutput, err := c.ecs.ListTagsForResourceWithContext(ctx, &ecs.ListTagsForResourceInput{
+		ResourceArn: taskDefinitionArn,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tagsOutput.Tags, nil
+}
@@ -0,0 +1,107 @@
+package deployer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// readOnlyTaskDefinitionFields are the ecs.TaskDefinition fields RegisterTaskDefinition does not accept
+var readOnlyTaskDefinitionFields = map[string]bool{
+	"TaskDefinitionArn":  true,
+	"Revision":           true,
+	"Status":             true,
+	"Compatibilities":    true,
+	"RequiresAttributes": true,
+	"RegisteredAt":       true,
+	"RegisteredBy":       true,
+	"DeregisteredAt":     true,
+}
+
+// fill sets every exported field reachable from v to a non-zero value
+func fill(v reflect.Value, depth int) {
+	if depth > 8 {
+		return
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		v.Set(reflect.New(v.Type().Elem()))
+		fill(v.Elem(), depth+1)
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Float64:
+		v.SetFloat(1)
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fill(v.Index(0), depth+1)
+	case reflect.Map:
+		v.Set(reflect.MakeMap(v.Type()))
+		key := reflect.New(v.Type().Key()).Elem()
+		value := reflect.New(v.Type().Elem()).Elem()
+		fill(key, depth+1)
+		fill(value, depth+1)
+		v.SetMapIndex(key, value)
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			v.Set(reflect.ValueOf(time.Unix(1700000000, 0)))
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				fill(v.Field(i), depth+1)
+			}
+		}
+	}
+}
+
+func TestNewRegisterTaskDefinitionInput(t *testing.T) {
+	td := &ecs.TaskDefinition{}
+	fill(reflect.ValueOf(td).Elem(), 0)
+
+	tags := []*ecs.Tag{
+		{Key: aws.String("team"), Value: aws.String("payments")},
+		{Key: aws.String("aws:cloudformation:stack-name"), Value: aws.String("app")},
+	}
+	rtdi := NewRegisterTaskDefinitionInput(td, tags)
+
+	tdValue := reflect.ValueOf(td).Elem()
+	inputValue := reflect.ValueOf(rtdi).Elem()
+
+	// Every writable field of the task definition is carried over unchanged
+	for i := 0; i < tdValue.NumField(); i++ {
+		field := tdValue.Type().Field(i)
+		if field.PkgPath != "" || readOnlyTaskDefinitionFields[field.Name] {
+			continue
+		}
+		inputField := inputValue.FieldByName(field.Name)
+		if !inputField.IsValid() {
+			t.Errorf("ecs.TaskDefinition.%s has no RegisterTaskDefinitionInput field; add it to readOnlyTaskDefinitionFields if it is read-only", field.Name)
+			continue
+		}
+		if !reflect.DeepEqual(inputField.Interface(), tdValue.Field(i).Interface()) {
+			t.Errorf("%s was not carried over", field.Name)
+		}
+	}
+
+	// Every field RegisterTaskDefinition accepts is set, so a field added to the SDK is not dropped silently
+	for i := 0; i < inputValue.NumField(); i++ {
+		field := inputValue.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		if inputValue.Field(i).IsZero() {
+			t.Errorf("RegisterTaskDefinitionInput.%s is not set", field.Name)
+		}
+	}
+
+	if len(rtdi.Tags) != 1 || aws.StringValue(rtdi.Tags[0].Key) != "team" {
+		t.Errorf("Tags = %v, want only the team tag", rtdi.Tags)
+	}
+}
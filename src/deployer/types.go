@@ -1,13 +1,15 @@
 package deployer
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/service/ecs"
 )
 
@@ -25,12 +27,108 @@ type DeploymentOptions struct {
 	Role string `json:"Role"`
 	// MaxAttempts is the Number of attempts to wait for service to become stable, with subsequent 15 sec pause.
 	MaxAttempts int `json:"MaxAttempts"`
+	// FailureThreshold aborts waiting once this many tasks of the new deployment have failed. Library default: 0
+	// (disabled); the CLI's --failure-threshold defaults to 3
+	FailureThreshold int `json:"FailureThreshold"`
+	// NoLock skips the deployment lock that serializes deployments of a service
+	NoLock bool `json:"NoLock"`
+	// LockTimeout is how long to wait for another deployment to release the lock. Default: 0 (fail immediately)
+	LockTimeout Duration `json:"LockTimeout"`
+	// LockTTL is how long a lock is held before it is considered abandoned. Default: 1h
+	LockTTL Duration `json:"LockTTL"`
+	// LockOwner identifies this deployment in the lock. Default: "<user>@<host>"
+	LockOwner string `json:"LockOwner"`
+	// SmokeTests are HTTP checks run once the service is stable; the deployment fails if any of them fails
+	SmokeTests []SmokeTest `json:"SmokeTests"`
+	// SkipTargetHealth treats a steady state as success without checking the new tasks' load balancer target health
+	SkipTargetHealth bool `json:"SkipTargetHealth"`
 	// RefreshSecrets will update all container definition secrets to include ssm parameters that exists with the prefix "/<cluster>/service/*"
 	RefreshSecrets bool `json:"RefreshSecrets"`
 	// The ssm parameter store prefix to pull secrets from. Default: "/<cluster>/service/*"
 	SecretsPrefix []string `json:"SecretsPrefix"`
 	// DryRun will preview changes
 	DryRun bool `json:"DryRun"`
+	// Container is the name of the container to update. Default: the first container in the task definition
+	Container string `json:"Container"`
+	// Images maps container names to their desired versions, updating several containers in one revision. Takes precedence over Container
+	Images map[string]string `json:"Images"`
+	// ContainerEnvironment sets environment variables, keyed by container name then variable name. Other variables are left unchanged
+	ContainerEnvironment map[string]map[string]string `json:"ContainerEnvironment"`
+	// Cpu overrides the task size cpu, e.g. "512" or "1 vCPU". Default: unchanged
+	Cpu string `json:"Cpu"`
+	// Memory overrides the task size memory, e.g. "1024" or "1 GB". Default: unchanged
+	Memory string `json:"Memory"`
+	// DesiredCount overrides the number of tasks the service runs. Default: unchanged
+	DesiredCount *int64 `json:"DesiredCount"`
+	// SkipImageCheck disables verifying that ECR images exist before registering a new task definition
+	SkipImageCheck bool `json:"SkipImageCheck"`
+	// FullDiff includes unchanged fields in the plan, not only the changed ones
+	FullDiff bool `json:"FullDiff"`
+	// VersionParameter is a text/template of the SSM parameter holding the desired version, rendered against these options. Default: "/{{.Environment}}/{{.Application}}/VERSION"
+	VersionParameter string `json:"VersionParameter"`
+	// NoVersionParameter skips reading and writing the SSM version parameter
+	NoVersionParameter bool `json:"NoVersionParameter"`
+	// SetVersionAfterStable defers writing the SSM version parameter until the service is stable. PublishVersion must then be called by the caller
+	SetVersionAfterStable bool `json:"SetVersionAfterStable"`
+	// Bake is how long to watch BakeAlarms once the service is stable
+	Bake Duration `json:"Bake"`
+	// BakeAlarms are CloudWatch alarm names that must stay out of ALARM during Bake
+	BakeAlarms []string `json:"BakeAlarms"`
+	// CircuitBreaker enables or disables the ECS deployment circuit breaker. Default: unchanged
+	CircuitBreaker *bool `json:"CircuitBreaker"`
+	// CircuitBreakerRollback makes ECS roll back deployments tripped by the circuit breaker. Default: unchanged
+	CircuitBreakerRollback *bool `json:"CircuitBreakerRollback"`
+	// DeploymentAlarms are CloudWatch alarms ECS monitors during deployment. An empty list disables them. Default: unchanged
+	DeploymentAlarms []string `json:"DeploymentAlarms"`
+	// DeploymentAlarmsRollback makes ECS roll back deployments when a DeploymentAlarms alarm triggers. Default: unchanged
+	DeploymentAlarmsRollback *bool `json:"DeploymentAlarmsRollback"`
+	// TaskDefinitionRevision pins the task definition revision to roll back to. Default: the revision prior to the current one
+	TaskDefinitionRevision int64 `json:"TaskDefinitionRevision"`
+	// CodeDeployApplication deploys CODE_DEPLOY services. Default: "AppECS-<cluster>-<service>"
+	CodeDeployApplication string `json:"CodeDeployApplication"`
+	// CodeDeployDeploymentGroup deploys CODE_DEPLOY services. Default: "DgpECS-<cluster>-<service>"
+	CodeDeployDeploymentGroup string `json:"CodeDeployDeploymentGroup"`
+	// Canary is the percentage of the desired count the new task set of an EXTERNAL service runs until it is promoted. Default: 100
+	Canary float64 `json:"Canary"`
+	// ShiftServices are the paired services traffic is shifted between. Default: "<application>-blue" and "<application>-green"
+	ShiftServices []string `json:"ShiftServices"`
+	// ShiftSteps are the percentages of traffic shifted to the idle service, in order. Default: 10, 50, 100
+	ShiftSteps []int64 `json:"ShiftSteps"`
+	// ShiftPause is how long to wait after each step before checking target health and BakeAlarms. Default: 1m
+	ShiftPause Duration `json:"ShiftPause"`
+	// ShiftListenerRule is the ARN of the listener rule splitting traffic between ShiftServices. Default: discovered from their target groups
+	ShiftListenerRule string `json:"ShiftListenerRule"`
+}
+
+// Duration is a time.Duration that is written to and read from JSON as a string such as "10m"
+type Duration time.Duration
+
+// MarshalJSON encodes the duration as a string such as "10m0s"
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON decodes a duration string such as "10m", or a number of seconds
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return err
+	}
+
+	switch value := v.(type) {
+	case float64:
+		*d = Duration(time.Duration(value * float64(time.Second)))
+	case string:
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(duration)
+	default:
+		return fmt.Errorf("invalid duration %s", b)
+	}
+	return nil
 }
 
 // DeploymentResults maintain the depyments latest results
@@ -41,33 +139,34 @@ type DeploymentResults struct {
 	ServiceArn          string `json:"ServiceArn"`
 	ServiceName         string `json:"ServiceName"`
 	TaskDefinition      string `json:"TaskDefinition"`
+	// CodeDeployDeploymentID is the CodeDeploy deployment of a service using the CODE_DEPLOY deployment controller
+	CodeDeployDeploymentID string `json:"CodeDeployDeploymentID,omitempty"`
+	// TaskSet is the task set of a service using the EXTERNAL deployment controller that was created, or rolled back to
+	TaskSet string `json:"TaskSet,omitempty"`
+	// SmokeTests are the results of the smoke tests run once the service was stable
+	SmokeTests []SmokeTestResult `json:"SmokeTests,omitempty"`
+	// Plan is the set of changes the deployment made, or would make with DryRun
+	Plan *Plan `json:"Plan,omitempty"`
 }
 
-func (depOpts *DeploymentOptions) SetDeploymentOptionsByEcsServiceTags() error {
-	// TODO: get ecs service tags that start with ecs-deploy:
-
-	var ecsClient *ecs.ECS
-	if depOpts.Role != "" {
-		creds := stscreds.NewCredentials(sess, depOpts.Role)
-		ecsClient = ecs.New(sess, &aws.Config{Credentials: creds})
-	} else {
-		ecsClient = ecs.New(sess)
-	}
-
-	ecsDescribeServicesOutput, err := ecsClient.DescribeServices(&ecs.DescribeServicesInput{
-		Cluster:  aws.String(depOpts.Environment),
-		Services: aws.StringSlice([]string{depOpts.Application}),
-	})
+// SetService records the ECS service a deployment was invoked against
+func (deploymentResults *DeploymentResults) SetService(service *ecs.Service) {
+	deploymentResults.SuccessfullyInvoked = true
+	deploymentResults.ClusterArn = aws.StringValue(service.ClusterArn)
+	deploymentResults.ServiceArn = aws.StringValue(service.ServiceArn)
+	deploymentResults.ServiceName = aws.StringValue(service.ServiceName)
+	deploymentResults.TaskDefinition = aws.StringValue(service.TaskDefinition)
+}
 
+// SetDeploymentOptionsByEcsServiceTags overrides depOpts with any "ecs-deploy:" tags set on the ECS service
+func (c *Client) SetDeploymentOptionsByEcsServiceTags(ctx context.Context, depOpts *DeploymentOptions) error {
+	service, err := c.describeService(ctx, *depOpts)
 	if err != nil {
 		return fmt.Errorf("Unable to describe services: %v", err)
 	}
-	if len(ecsDescribeServicesOutput.Services) == 0 {
-		return fmt.Errorf("ECS service not found.")
-	}
 
-	tagsOutput, err := ecsClient.ListTagsForResource(&ecs.ListTagsForResourceInput{
-		ResourceArn: ecsDescribeServicesOutput.Services[0].ServiceArn,
+	tagsOutput, err := c.ecs.ListTagsForResourceWithContext(ctx, &ecs.ListTagsForResourceInput{
+		ResourceArn: service.ServiceArn,
 	})
 	if err != nil {
 		return fmt.Errorf("Unable to get ecs service tags: %v", err)
@@ -84,15 +183,45 @@ func (depOpts *DeploymentOptions) SetDeploymentOptionsByEcsServiceTags() error {
 				} else {
 					depOpts.RefreshSecrets = value
 				}
-				fmt.Println(fmt.Sprintf("ECS service tag found: \"%s=%s\". Setting --refresh-secrets to %t", *tag.Key, *tag.Value, depOpts.RefreshSecrets))
+				fmt.Fprintf(c.out, "ECS service tag found: \"%s=%s\". Setting --refresh-secrets to %t\n", *tag.Key, *tag.Value, depOpts.RefreshSecrets)
 
 			case "secrets-prefix":
 				value := strings.Split(*tag.Value, ":")
 				depOpts.SecretsPrefix = value
-				fmt.Println(fmt.Sprintf("ECS service tag found: \"%s=%s\". Setting --secrets-prefix to %v", *tag.Key, *tag.Value, depOpts.SecretsPrefix))
+				fmt.Fprintf(c.out, "ECS service tag found: \"%s=%s\". Setting --secrets-prefix to %v\n", *tag.Key, *tag.Value, depOpts.SecretsPrefix)
+
+			case "circuit-breaker":
+				depOpts.CircuitBreaker = parseBoolTag(*tag.Value)
+				fmt.Fprintf(c.out, "ECS service tag found: \"%s=%s\". Setting --circuit-breaker to %t\n", *tag.Key, *tag.Value, *depOpts.CircuitBreaker)
+
+			case "circuit-breaker-rollback":
+				depOpts.CircuitBreakerRollback = parseBoolTag(*tag.Value)
+				fmt.Fprintf(c.out, "ECS service tag found: \"%s=%s\". Setting --circuit-breaker-rollback to %t\n", *tag.Key, *tag.Value, *depOpts.CircuitBreakerRollback)
+
+			case "deployment-alarms":
+				depOpts.DeploymentAlarms = strings.Split(*tag.Value, ":")
+				fmt.Fprintf(c.out, "ECS service tag found: \"%s=%s\". Setting --deployment-alarm to %v\n", *tag.Key, *tag.Value, depOpts.DeploymentAlarms)
+
+			case "deployment-alarms-rollback":
+				depOpts.DeploymentAlarmsRollback = parseBoolTag(*tag.Value)
+				fmt.Fprintf(c.out, "ECS service tag found: \"%s=%s\". Setting --deployment-alarms-rollback to %t\n", *tag.Key, *tag.Value, *depOpts.DeploymentAlarmsRollback)
+
+			case "codedeploy-application":
+				depOpts.CodeDeployApplication = *tag.Value
+				fmt.Fprintf(c.out, "ECS service tag found: \"%s=%s\". Setting --codedeploy-application to %s\n", *tag.Key, *tag.Value, depOpts.CodeDeployApplication)
+
+			case "codedeploy-deployment-group":
+				depOpts.CodeDeployDeploymentGroup = *tag.Value
+				fmt.Fprintf(c.out, "ECS service tag found: \"%s=%s\". Setting --codedeploy-deployment-group to %s\n", *tag.Key, *tag.Value, depOpts.CodeDeployDeploymentGroup)
 			}
 		}
 	}
 
 	return nil
 }
+
+// parseBoolTag parses a boolean tag value, treating anything unparsable as false like refresh-secrets
+func parseBoolTag(value string) *bool {
+	b, err := strconv.ParseBool(value)
+	return aws.Bool(err == nil && b)
+}
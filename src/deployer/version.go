@@ -0,0 +1,115 @@
+package deployer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// DefaultVersionParameter is the template of the SSM parameter holding the desired version of an application
+const DefaultVersionParameter = "/{{.Environment}}/{{.Application}}/VERSION"
+
+// versionParameterName renders the VersionParameter template (DefaultVersionParameter when unset) against depOpts
+func versionParameterName(depOpts DeploymentOptions) (string, error) {
+	text := depOpts.VersionParameter
+	if text == "" {
+		text = DefaultVersionParameter
+	}
+
+	tmpl, err := template.New("VersionParameter").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid version parameter template %q: %v", text, err)
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, depOpts)
+	if err != nil {
+		return "", fmt.Errorf("invalid version parameter template %q: %v", text, err)
+	}
+	return buf.String(), nil
+}
+
+// PublishVersion writes the plan's version to the SSM version parameter, unless NoVersionParameter is set
+func (c *Client) PublishVersion(ctx context.Context, plan *Plan) error {
+	if plan.Options.NoVersionParameter {
+		return nil
+	}
+	name, err := plan.versionParameterName()
+	if err != nil {
+		return err
+	}
+	return c.putVersionParameter(ctx, name, plan.Options.Version, plan.Options.Description)
+}
+
+// RevertVersion restores the SSM version parameter to the value recorded in the plan, unless NoVersionParameter is set
+func (c *Client) RevertVersion(ctx context.Context, plan *Plan) error {
+	if plan.Options.NoVersionParameter {
+		return nil
+	}
+	name, err := plan.versionParameterName()
+	if err != nil {
+		return err
+	}
+	return c.restoreDesiredVersion(ctx, name, plan.Options.Description, plan.PreviousVersion)
+}
+
+// versionParameterName returns the version parameter recorded when the plan was made. The template is only rendered
+// again for plans that did not record it, as rendering it against another version can name another parameter.
+func (plan *Plan) versionParameterName() (string, error) {
+	if plan.VersionParameter != "" {
+		return plan.VersionParameter, nil
+	}
+	return versionParameterName(plan.Options)
+}
+
+// getDesiredVersion returns the current desired version, or nil when the parameter does not exist
+func (c *Client) getDesiredVersion(ctx context.Context, depOpts DeploymentOptions) (*string, error) {
+	name, err := versionParameterName(depOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	gpo, err := c.ssm.GetParameterWithContext(ctx, &ssm.GetParameterInput{
+		Name: aws.String(name),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeParameterNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return gpo.Parameter.Value, nil
+}
+
+// restoreDesiredVersion sets the version parameter name back to previous, deleting it when it did not exist before
+func (c *Client) restoreDesiredVersion(ctx context.Context, name, description string, previous *string) error {
+	if previous == nil {
+		_, err := c.ssm.DeleteParameterWithContext(ctx, &ssm.DeleteParameterInput{
+			Name: aws.String(name),
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeParameterNotFound {
+			return nil
+		}
+		return err
+	}
+
+	return c.putVersionParameter(ctx, name, *previous, description)
+}
+
+// putVersionParameter writes version to the version parameter name
+func (c *Client) putVersionParameter(ctx context.Context, name, version, description string) error {
+	input := &ssm.PutParameterInput{
+		Name:        aws.String(name),
+		Overwrite:   aws.Bool(true),
+		Type:        aws.String("String"),
+		Description: aws.String(description),
+		Value:       aws.String(version),
+	}
+	_, err := c.ssm.PutParameterWithContext(ctx, input)
+	return err
+}
@@ -0,0 +1,287 @@
+package deployer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+const (
+	// defaultWaitInterval is the pause between polls of the ECS service while waiting for a deployment
+	defaultWaitInterval = 15 * time.Second
+	// defaultMaxAttempts is used when DeploymentOptions.MaxAttempts is not set
+	defaultMaxAttempts = 40
+)
+
+// WaitForDeployment polls the ECS service until it reaches a stable state with every new task healthy in its load
+// balancer target groups, or MaxAttempts is exhausted.
+// Service events are streamed as they arrive along with the running, pending and desired counts and the
+// rollout state of each deployment, so a stuck rollout can be diagnosed without opening the console.
+func (c *Client) WaitForDeployment(ctx context.Context, depOpts DeploymentOptions) error {
+	maxAttempts := depOpts.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+
+	var seen map[string]bool
+	var deploymentID string
+	for attempt := 1; ; attempt++ {
+		service, err := c.describeService(ctx, depOpts)
+		if err != nil {
+			return err
+		}
+
+		// Track the deployment being rolled out when we started waiting
+		if deploymentID == "" {
+			if primary := primaryDeployment(service); primary != nil {
+				deploymentID = aws.StringValue(primary.Id)
+			}
+		}
+
+		// Only stream events raised after we started waiting
+		if seen == nil {
+			seen = map[string]bool{}
+			for _, event := range service.Events {
+				seen[aws.StringValue(event.Id)] = true
+			}
+		}
+		c.printServiceEvents(service, seen)
+		c.printDeployments(service)
+
+		// The circuit breaker or deployment alarms failed the rollout
+		if d := findDeployment(service, deploymentID); d != nil && aws.StringValue(d.RolloutState) == ecs.DeploymentRolloutStateFailed {
+			return &RolloutFailedError{
+				TaskDefinition: aws.StringValue(d.TaskDefinition),
+				Reason:         aws.StringValue(d.RolloutStateReason),
+				RolledBack:     rollsBackOnFailure(service.DeploymentConfiguration),
+			}
+		}
+
+		// A steady state only counts once the new tasks pass their load balancer health checks
+		var unhealthy *UnhealthyTargetsError
+		if serviceIsStable(service) {
+			if depOpts.SkipTargetHealth {
+				return nil
+			}
+			err = c.checkDeploymentTargetHealth(ctx, service, aws.StringValue(service.Deployments[0].Id))
+			if err == nil {
+				return nil
+			}
+			if !errors.As(err, &unhealthy) {
+				return err
+			}
+			c.printUnhealthyTargets(unhealthy)
+		}
+
+		// Abort early when the new deployment's tasks keep crashing
+		if primary := primaryDeployment(service); primary != nil && depOpts.FailureThreshold > 0 && aws.Int64Value(primary.FailedTasks) >= int64(depOpts.FailureThreshold) {
+			return c.newTaskFailureError(ctx, service, primary)
+		}
+
+		if attempt >= maxAttempts {
+			if unhealthy != nil {
+				return unhealthy
+			}
+			return fmt.Errorf("service %s did not reach a stable state after %d attempts", depOpts.Application, maxAttempts)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.waitInterval):
+		}
+	}
+}
+
+// serviceIsStable matches the ECS ServicesStable waiter: a single deployment running its desired count
+func serviceIsStable(service *ecs.Service) bool {
+	return len(service.Deployments) == 1 && aws.Int64Value(service.RunningCount) == aws.Int64Value(service.DesiredCount)
+}
+
+// printServiceEvents prints events not yet seen, oldest first
+func (c *Client) printServiceEvents(service *ecs.Service, seen map[string]bool) {
+	// ECS returns the newest event first
+	for i := len(service.Events) - 1; i >= 0; i-- {
+		event := service.Events[i]
+		if seen[aws.StringValue(event.Id)] {
+			continue
+		}
+		seen[aws.StringValue(event.Id)] = true
+		fmt.Fprintf(c.out, "%s  %s\n", aws.TimeValue(event.CreatedAt).Local().Format(time.Kitchen), aws.StringValue(event.Message))
+	}
+}
+
+// printDeployments prints the progress of every deployment of the service
+func (c *Client) printDeployments(service *ecs.Service) {
+	for _, d := range service.Deployments {
+		taskDefinition := aws.StringValue(d.TaskDefinition)
+		if family, revision, err := parseTaskDefinitionArn(taskDefinition); err == nil {
+			taskDefinition = fmt.Sprintf("%s:%d", family, revision)
+		}
+
+		line := fmt.Sprintf("  %-8s %s  running %d/%d, pending %d",
+			aws.StringValue(d.Status), taskDefinition,
+			aws.Int64Value(d.RunningCount), aws.Int64Value(d.DesiredCount), aws.Int64Value(d.PendingCount))
+		if d.RolloutState != nil {
+			line += fmt.Sprintf(", rollout %s", aws.StringValue(d.RolloutState))
+		}
+		fmt.Fprintln(c.out, line)
+	}
+}
+
+// printUnhealthyTargets prints why each target of the new deployment is not yet healthy
+func (c *Client) printUnhealthyTargets(unhealthy *UnhealthyTargetsError) {
+	for _, target := range unhealthy.Targets {
+		line := fmt.Sprintf("  target %s %s in %s", target.Target, target.State, targetGroupName(unhealthy.TargetGroup))
+		if target.Reason != "" {
+			line += fmt.Sprintf(": %s %s", target.Reason, target.Description)
+		}
+		fmt.Fprintln(c.out, line)
+	}
+}
+
+// primaryDeployment returns the deployment ECS is rolling out, if any
+func primaryDeployment(service *ecs.Service) *ecs.Deployment {
+	for _, d := range service.Deployments {
+		if aws.StringValue(d.Status) == "PRIMARY" {
+			return d
+		}
+	}
+	return nil
+}
+
+// findDeployment returns the service deployment with the given id, if any
+func findDeployment(service *ecs.Service, id string) *ecs.Deployment {
+	for _, d := range service.Deployments {
+		if aws.StringValue(d.Id) == id {
+			return d
+		}
+	}
+	return nil
+}
+
+// RolloutFailedError is returned when ECS marks the rollout FAILED, through the deployment circuit breaker or deployment alarms
+type RolloutFailedError struct {
+	// TaskDefinition of the failed deployment
+	TaskDefinition string
+	// Reason ECS gave for failing the rollout
+	Reason string
+	// RolledBack is true when ECS rolls the service back to the last completed deployment by itself
+	RolledBack bool
+	// Controller that failed the rollout: ECS, or CodeDeploy for blue/green deployments. Default: ECS
+	Controller string
+	// DeploymentID of the failed CodeDeploy deployment
+	DeploymentID string
+}
+
+func (e *RolloutFailedError) Error() string {
+	deployment := e.TaskDefinition
+	if e.DeploymentID != "" {
+		deployment = strings.TrimSpace(fmt.Sprintf("%s (CodeDeploy deployment %s)", e.TaskDefinition, e.DeploymentID))
+	}
+	if e.RolledBack {
+		controller := e.Controller
+		if controller == "" {
+			controller = "ECS"
+		}
+		return fmt.Sprintf("rolled back by %s: deployment of %s failed: %s", controller, deployment, e.Reason)
+	}
+	return fmt.Sprintf("deployment of %s failed: %s", deployment, e.Reason)
+}
+
+// TaskFailureError is returned when the tasks of a deployment fail more often than the FailureThreshold
+type TaskFailureError struct {
+	// Deployment is the ECS deployment id
+	Deployment string
+	// TaskDefinition the failing tasks were started from
+	TaskDefinition string
+	// FailedTasks is the number of tasks ECS reports as failed for the deployment
+	FailedTasks int64
+	// StoppedTasks are the most recently stopped tasks of the deployment
+	StoppedTasks []StoppedTask
+}
+
+// StoppedTask describes why a task stopped
+type StoppedTask struct {
+	TaskArn       string             `json:"TaskArn"`
+	StoppedReason string             `json:"StoppedReason"`
+	Containers    []StoppedContainer `json:"Containers"`
+}
+
+// StoppedContainer describes how a container of a stopped task exited
+type StoppedContainer struct {
+	Name     string `json:"Name"`
+	ExitCode *int64 `json:"ExitCode,omitempty"`
+	Reason   string `json:"Reason,omitempty"`
+}
+
+func (e *TaskFailureError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d tasks of %s failed to start", e.FailedTasks, e.TaskDefinition)
+	for _, task := range e.StoppedTasks {
+		fmt.Fprintf(&sb, "\n  task %s: %s", task.TaskArn[strings.LastIndex(task.TaskArn, "/")+1:], task.StoppedReason)
+		for _, container := range task.Containers {
+			fmt.Fprintf(&sb, "\n    container %s", container.Name)
+			if container.ExitCode != nil {
+				fmt.Fprintf(&sb, " exited with code %d", *container.ExitCode)
+			}
+			if container.Reason != "" {
+				fmt.Fprintf(&sb, ": %s", container.Reason)
+			}
+		}
+	}
+	return sb.String()
+}
+
+// newTaskFailureError describes the stopped tasks started by a deployment
+func (c *Client) newTaskFailureError(ctx context.Context, service *ecs.Service, deployment *ecs.Deployment) error {
+	taskFailureError := &TaskFailureError{
+		Deployment:     aws.StringValue(deployment.Id),
+		TaskDefinition: aws.StringValue(deployment.TaskDefinition),
+		FailedTasks:    aws.Int64Value(deployment.FailedTasks),
+	}
+
+	lto, err := c.ecs.ListTasksWithContext(ctx, &ecs.ListTasksInput{
+		Cluster:       service.ClusterArn,
+		ServiceName:   service.ServiceName,
+		DesiredStatus: aws.String(ecs.DesiredStatusStopped),
+	})
+	if err != nil || len(lto.TaskArns) == 0 {
+		return taskFailureError
+	}
+
+	dto, err := c.ecs.DescribeTasksWithContext(ctx, &ecs.DescribeTasksInput{
+		Cluster: service.ClusterArn,
+		Tasks:   lto.TaskArns,
+	})
+	if err != nil {
+		return taskFailureError
+	}
+
+	for _, task := range dto.Tasks {
+		// Services start tasks as "ecs-svc/<deployment id>"
+		if aws.StringValue(task.StartedBy) != taskFailureError.Deployment {
+			continue
+		}
+
+		stoppedTask := StoppedTask{
+			TaskArn:       aws.StringValue(task.TaskArn),
+			StoppedReason: aws.StringValue(task.StoppedReason),
+		}
+		for _, container := range task.Containers {
+			stoppedTask.Containers = append(stoppedTask.Containers, StoppedContainer{
+				Name:     aws.StringValue(container.Name),
+				ExitCode: container.ExitCode,
+				Reason:   aws.StringValue(container.Reason),
+			})
+		}
+		taskFailureError.StoppedTasks = append(taskFailureError.StoppedTasks, stoppedTask)
+	}
+
+	return taskFailureError
+}
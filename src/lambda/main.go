@@ -1,6 +1,7 @@
 package ld
 
 import (
+	"context"
 	"errors"
 	"log"
 
@@ -16,20 +17,25 @@ var (
 
 // Handler is your Lambda function handler
 // It uses the DeploymentOptions JSON event to invoke a deployment against ECS
-func Handler(depOpts deployer.DeploymentOptions) (s string, err error) {
+func Handler(ctx context.Context, depOpts deployer.DeploymentOptions) (*deployer.DeploymentResults, error) {
 
 	// stdout and stderr are sent to AWS CloudWatch Logs
 	log.Printf("Processing request to deploy %s@%s to %s\n", depOpts.Application, depOpts.Version, depOpts.Environment)
 
 	if !inputValidation(depOpts) {
-		return s, ErrInvalidInputProvided
+		return nil, ErrInvalidInputProvided
 	}
 
 	if depOpts.Description == "" {
 		depOpts.Description = defaultSSMDescription
 	}
 
-	return deployer.PerformDeployment(depOpts)
+	client, err := deployer.NewClient(deployer.WithRole(depOpts.Role))
+	if err != nil {
+		return nil, err
+	}
+
+	return client.PerformDeployment(ctx, depOpts)
 }
 
 // Start the lambda function
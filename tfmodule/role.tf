@@ -46,8 +46,21 @@ variable "iam_policy" {
             "logs:CreateLogGroup",
             "ecs:*",
             "ecr:List*",
+            "ecr:DescribeImages",
             "ssm:Get*",
             "ssm:Put*",
+            "ssm:DeleteParameter",
+            "cloudwatch:DescribeAlarms",
+            "codedeploy:CreateDeployment",
+            "codedeploy:GetDeployment",
+            "codedeploy:ListDeploymentTargets",
+            "codedeploy:BatchGetDeploymentTargets",
+            "codedeploy:StopDeployment",
+            "elasticloadbalancing:DescribeTargetGroups",
+            "elasticloadbalancing:DescribeListeners",
+            "elasticloadbalancing:DescribeRules",
+            "elasticloadbalancing:DescribeTargetHealth",
+            "elasticloadbalancing:ModifyRule",
             "ssm:List*",
             "iam:PassRole"
          ],